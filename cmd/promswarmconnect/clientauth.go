@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// our API reveals every service's internal IP and port, so optionally require Prometheus to
+// authenticate with a client certificate (Prometheus' "tls_config" with "cert_file" and
+// "key_file") signed by a CA we trust
+func configureClientAuthFromEnv(tlsConfig *tls.Config) error {
+	if os.Getenv("TLS_CLIENT_CA") == "" {
+		if os.Getenv("TLS_CLIENT_ALLOWED_CNS") != "" {
+			return errors.New("TLS_CLIENT_ALLOWED_CNS requires TLS_CLIENT_CA")
+		}
+
+		return nil // client auth not enabled
+	}
+
+	clientCaPem, err := getDataFromEnvBase64OrFile("TLS_CLIENT_CA")
+	if err != nil {
+		return err
+	}
+
+	clientCas := x509.NewCertPool()
+	if !clientCas.AppendCertsFromPEM(clientCaPem) {
+		return errors.New("TLS_CLIENT_CA: no certificates found")
+	}
+
+	tlsConfig.ClientCAs = clientCas
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	if allowedCnsSerialized := os.Getenv("TLS_CLIENT_ALLOWED_CNS"); allowedCnsSerialized != "" {
+		allowed := allowedCommonNames{}
+		for _, commonName := range strings.Split(allowedCnsSerialized, ",") {
+			allowed = append(allowed, strings.TrimSpace(commonName))
+		}
+
+		tlsConfig.VerifyPeerCertificate = allowed.verify
+	}
+
+	return nil
+}
+
+// if CA is shared with other uses, this limits which of its certificates are accepted
+type allowedCommonNames []string
+
+// for tls.Config.VerifyPeerCertificate. only called after the chain was verified against our CA
+func (a allowedCommonNames) verify(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return errors.New("no verified client certificate")
+	}
+
+	commonName := verifiedChains[0][0].Subject.CommonName
+
+	if !stringSliceContains(a, commonName) {
+		return fmt.Errorf("client certificate CN not allowed: %s", commonName)
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestAllowedCommonNames(t *testing.T) {
+	allowed := allowedCommonNames{"prometheus", "prometheus-replica"}
+
+	chainFor := func(commonName string) [][]*x509.Certificate {
+		return [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: commonName}}}}
+	}
+
+	assert.Ok(t, allowed.verify(nil, chainFor("prometheus")))
+	assert.Ok(t, allowed.verify(nil, chainFor("prometheus-replica")))
+	assert.EqualString(t, allowed.verify(nil, chainFor("curious-container")).Error(), "client certificate CN not allowed: curious-container")
+	assert.EqualString(t, allowed.verify(nil, nil).Error(), "no verified client certificate")
+}
+
+func TestConfigureClientAuthFromEnv(t *testing.T) {
+	tlsConfig := &tls.Config{}
+
+	assert.Ok(t, configureClientAuthFromEnv(tlsConfig))
+	assert.Assert(t, tlsConfig.ClientAuth == tls.NoClientCert)
+
+	os.Setenv("TLS_CLIENT_ALLOWED_CNS", "prometheus")
+	defer os.Unsetenv("TLS_CLIENT_ALLOWED_CNS")
+
+	assert.EqualString(t, configureClientAuthFromEnv(tlsConfig).Error(), "TLS_CLIENT_ALLOWED_CNS requires TLS_CLIENT_CA")
+}
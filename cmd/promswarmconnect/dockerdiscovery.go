@@ -2,80 +2,281 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/function61/gokit/app/udocker"
 	"github.com/function61/gokit/net/http/ezhttp"
 	"github.com/function61/gokit/os/osutil"
 )
 
-func listDockerServiceAndContainerInstances(
+// raw Docker API objects that we derive Services from. kept separate from the conversion
+// so the discovery cache can update the pieces individually
+type dockerState struct {
+	info       dockerInfo
+	tasks      []dockerTask
+	services   []dockerService
+	nodes      []udocker.Node
+	containers []dockerContainer
+	// standalone container ID => its ENV vars. the container list doesn't have them
+	containerEnvs map[string]map[string]string
+}
+
+// max concurrent container inspect calls, so we don't hammer Docker with hundreds of
+// containers on initial sync
+const containerInspectConcurrency = 4
+
+// "knownContainerEnvs" are reused instead of inspecting the containers again
+func fetchDockerState(
 	ctx context.Context,
 	dockerUrl string,
-	networkName string,
 	dockerClient *http.Client,
-) ([]Service, error) {
-	services, err := listDockerServiceInstances(ctx, dockerUrl, networkName, dockerClient)
-	if err != nil {
+	knownContainerEnvs map[string]map[string]string,
+) (*dockerState, error) {
+	// all the requests have to finish within this timeout
+	ctx, cancel := context.WithTimeout(ctx, ezhttp.DefaultTimeout10s)
+	defer cancel()
+
+	state := &dockerState{}
+
+	if err := dockerGetJson(ctx, "info", dockerUrl+dockerInfoEndpoint, &state.info, dockerClient); err != nil {
+		state.info = dockerInfo{}
+		state.info.Swarm.LocalNodeState = swarmNodeStateUnknown
+	}
+
+	// on a plain Docker host or a Swarm worker these would fail, but we can still discover
+	// standalone containers
+	if state.info.useSwarmApis() {
+		if err := dockerGetJson(ctx, "tasks", dockerUrl+udocker.TasksEndpoint, &state.tasks, dockerClient); err != nil {
+			return nil, err
+		}
+
+		if err := dockerGetJson(ctx, "services", dockerUrl+udocker.ServicesEndpoint, &state.services, dockerClient); err != nil {
+			return nil, err
+		}
+
+		if err := dockerGetJson(ctx, "nodes", dockerUrl+udocker.NodesEndpoint, &state.nodes, dockerClient); err != nil {
+			return nil, err
+		}
+
+		// the task list above only has tasks whose desired state is running
+		for _, service := range state.services {
+			if !service.Spec.Mode.job() {
+				continue
+			}
+
+			jobTasks := []dockerTask{}
+			if err := dockerGetJson(ctx, "service_tasks", dockerUrl+dockerJobTasksForServiceEndpoint(service.ID), &jobTasks, dockerClient); err != nil {
+				return nil, err
+			}
+
+			state.tasks = append(state.tasks, jobTasks...)
+		}
+	}
+
+	if err := dockerGetJson(ctx, "containers", dockerUrl+udocker.ListContainersEndpoint, &state.containers, dockerClient); err != nil {
 		return nil, err
 	}
 
-	containersAsServices, err := listDockerContainerInstances(ctx, dockerUrl, networkName, dockerClient)
+	containerEnvs, err := inspectContainerEnvs(ctx, dockerUrl, state.containers, knownContainerEnvs, dockerClient)
 	if err != nil {
 		return nil, err
 	}
 
-	return append(services, containersAsServices...), nil
+	state.containerEnvs = containerEnvs
+
+	return state, nil
 }
 
-func listDockerServiceInstances(
+// returns ENV vars of standalone containers (Swarm tasks get theirs from the service spec).
+// container's ENV vars can't change after it's created, so for containers found in "known"
+// we don't need to ask Docker again. the returned map only has the given containers, so
+// removed containers drop out of the cache.
+func inspectContainerEnvs(
 	ctx context.Context,
 	dockerUrl string,
-	networkName string,
+	containers []dockerContainer,
+	known map[string]map[string]string,
 	dockerClient *http.Client,
-) ([]Service, error) {
-	// all the requests have to finish within this timeout
-	ctx, cancel := context.WithTimeout(ctx, ezhttp.DefaultTimeout10s)
-	defer cancel()
+) (map[string]map[string]string, error) {
+	envs := map[string]map[string]string{}
+	envsMu := sync.Mutex{}
 
-	dockerTasks := []udocker.Task{}
-	if _, err := ezhttp.Get(
-		ctx,
-		dockerUrl+udocker.TasksEndpoint,
-		ezhttp.Client(dockerClient),
-		ezhttp.RespondsJsonAllowUnknownFields(&dockerTasks),
-	); err != nil {
-		return nil, err
+	toInspect := []string{}
+	for _, container := range containers {
+		if isSwarmTaskContainer(container) {
+			continue
+		}
+
+		if containerEnvs, found := known[container.Id]; found {
+			envs[container.Id] = containerEnvs
+		} else {
+			toInspect = append(toInspect, container.Id)
+		}
 	}
 
-	dockerServices := []udocker.Service{}
-	if _, err := ezhttp.Get(
-		ctx,
-		dockerUrl+udocker.ServicesEndpoint,
-		ezhttp.Client(dockerClient),
-		ezhttp.RespondsJsonAllowUnknownFields(&dockerServices),
-	); err != nil {
-		return nil, err
+	work := make(chan string)
+	errs := make(chan error, len(toInspect))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < containerInspectConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for containerId := range work {
+				container := udocker.Container{}
+				err := dockerGetJson(ctx, "container_inspect", dockerUrl+udocker.ContainerInspectEndpoint(containerId), &container, dockerClient)
+				switch {
+				case ezhttp.ErrorIs(err, http.StatusNotFound):
+					// removed after we listed it. next container list won't have it either
+				case err != nil:
+					errs <- err
+				default:
+					envsMu.Lock()
+					envs[containerId] = parseEnvs(container.Config.Env)
+					envsMu.Unlock()
+				}
+			}
+		}()
 	}
 
-	dockerNodes := []udocker.Node{}
-	if _, err := ezhttp.Get(
-		ctx,
-		dockerUrl+udocker.NodesEndpoint,
-		ezhttp.Client(dockerClient),
-		ezhttp.RespondsJsonAllowUnknownFields(&dockerNodes),
-	); err != nil {
+	for _, containerId := range toInspect {
+		work <- containerId
+	}
+	close(work)
+
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
 		return nil, err
 	}
 
+	return envs, nil
+}
+
+type dockerDiscoveryConfig struct {
+	networkNames    []string // in priority order. if empty, detected from our own container
+	selfContainerId string   // for detecting networkNames
+	taskStates      taskStatePolicy
+	clusterName     string // "" if we only have one Docker endpoint
+
+	addressFamily addressFamily
+
+	jobNameStrategy jobNameStrategy
+}
+
+// discovery sources, for status reporting
+const (
+	discoverySourceSwarmServices = "swarm_services"
+	discoverySourceContainers    = "containers"
+)
+
+// which discovery sources are active for a Docker endpoint, and why
+type DiscoveryStatus struct {
+	Cluster        string   `json:"cluster,omitempty"`
+	SwarmNodeState string   `json:"swarm_node_state,omitempty"` // "inactive" for plain Docker hosts, "unknown" if we couldn't ask
+	SwarmManager   bool     `json:"swarm_manager"`
+	Sources        []string `json:"sources"`
+	Networks       []string `json:"networks"`        // scrape networks, in priority order
+	Error          string   `json:"error,omitempty"` // discovery for the endpoint is failing
+}
+
+// if not configured, networks are detected from our own container. done on each refresh, so
+// we follow if our service's networks change
+func resolveNetworkNames(state dockerState, conf dockerDiscoveryConfig) (dockerDiscoveryConfig, error) {
+	if len(conf.networkNames) > 0 {
+		return conf, nil
+	}
+
+	networkNames, err := selfNetworkNames(state, conf.selfContainerId)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.networkNames = networkNames
+
+	return conf, nil
+}
+
+func dockerStateToStatus(state dockerState, conf dockerDiscoveryConfig) DiscoveryStatus {
+	sources := []string{}
+	if state.info.useSwarmApis() {
+		sources = append(sources, discoverySourceSwarmServices)
+	}
+	sources = append(sources, discoverySourceContainers)
+
+	// error would've already surfaced from dockerStateToServices()
+	conf, _ = resolveNetworkNames(state, conf)
+
+	return DiscoveryStatus{
+		Cluster:        conf.clusterName,
+		Networks:       conf.networkNames,
+		SwarmNodeState: state.info.Swarm.LocalNodeState,
+		SwarmManager:   state.info.swarmManager(),
+		Sources:        sources,
+	}
+}
+
+// reasons for skipping a task or a container
+const (
+	skipReasonNoNetworkAttachment = "no_network_attachment"
+	skipReasonNoIp                = "no_ip"
+)
+
+// skip reason => count
+type skipCounts map[string]int
+
+func dockerStateToServices(state dockerState, conf dockerDiscoveryConfig) ([]Service, skipCounts, error) {
+	conf, err := resolveNetworkNames(state, conf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	skipped := skipCounts{}
+
+	services, err := dockerServicesToServices(state, conf, skipped)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	services = append(services, dockerContainersToServices(state, conf, skipped)...)
+
+	for idx := range services {
+		services[idx].Cluster = conf.clusterName
+	}
+
+	return services, skipped, nil
+}
+
+func dockerServicesToServices(state dockerState, conf dockerDiscoveryConfig, skipped skipCounts) ([]Service, error) {
 	services := []Service{}
 
-	for _, dockerService := range dockerServices {
+	for _, dockerService := range state.services {
+		envs := parseEnvs(dockerService.Spec.TaskTemplate.ContainerSpec.Env)
+
+		// service-level labels take precedence over container labels
+		labels := map[string]string{}
+		for key, value := range dockerService.Spec.TaskTemplate.ContainerSpec.Labels {
+			labels[key] = value
+		}
+		for key, value := range dockerService.Spec.Labels {
+			labels[key] = value
+		}
+
+		// skips of services that don't want to be scraped are uninteresting
+		wantsScraping := declaresEndpointSpecifier(Service{ENVs: envs, Labels: labels})
+
 		instances := []ServiceInstance{}
 
-		for _, task := range dockerTasks {
+		for _, task := range state.tasks {
 			if task.ServiceID != dockerService.ID {
 				continue
 			}
@@ -86,34 +287,68 @@ func listDockerServiceInstances(
 				continue
 			}
 
-			node := nodeById(task.NodeID, dockerNodes)
+			// shutdown, failed etc. tasks can still carry a network attachment, but
+			// scraping them would only produce "up == 0" noise
+			if !conf.taskStates.scrapeable(task, dockerService.Spec.Mode.job()) {
+				continue
+			}
+
+			node := nodeById(task.NodeID, state.nodes)
 			if node == nil {
 				return nil, fmt.Errorf("node %s not found for task %s", task.NodeID, task.ID)
 			}
 
-			ip, err := func() (string, error) {
-				if attachment := networkAttachmentForNetworkName(task, networkName); attachment != nil && len(attachment.Addresses) > 0 {
+			networks := []ServiceInstanceNetwork{}
+			attached := false // to any of our networks, even if without address
+
+			for _, networkName := range conf.networkNames {
+				attachment := networkAttachmentForNetworkName(task, networkName)
+				if attachment == nil {
+					continue
+				}
+
+				attached = true
+
+				// dual-stack networks have both IPv4 and IPv6 address
+				ips := []string{}
+				for _, address := range attachment.Addresses {
 					// for some reason Docker insists on stuffing the CIDR after the IP
-					firstIp, _, err := net.ParseCIDR(attachment.Addresses[0])
+					ip, _, err := net.ParseCIDR(address)
 					if err != nil {
-						return "", err
+						return nil, err
 					}
 
-					return firstIp.String(), nil
+					ips = append(ips, ip.String())
 				}
 
-				// fallback for host networking
-				if hostAttachment := networkAttachmentForNetworkName(task, "host"); hostAttachment != nil && node.Status.Addr != "" {
-					return node.Status.Addr, nil
+				if len(ips) > 0 {
+					networks = append(networks, ServiceInstanceNetwork{
+						Name: networkName,
+						IPs:  conf.addressFamily.sort(ips),
+					})
 				}
+			}
 
-				return "", nil
-			}()
-			if err != nil {
-				return nil, err
+			// fallback for host networking
+			if hostAttachment := networkAttachmentForNetworkName(task, "host"); hostAttachment != nil {
+				attached = true
+
+				if node.Status.Addr != "" {
+					networks = append(networks, ServiceInstanceNetwork{
+						Name: "host",
+						IPs:  []string{node.Status.Addr},
+					})
+				}
 			}
 
-			if ip == "" { // failed to find address for the task
+			if len(networks) == 0 { // failed to find address for the task
+				switch {
+				case !wantsScraping:
+				case !attached:
+					skipped[skipReasonNoNetworkAttachment]++
+				default:
+					skipped[skipReasonNoIp]++
+				}
 				continue
 			}
 
@@ -121,23 +356,19 @@ func listDockerServiceInstances(
 				DockerTaskId: task.ID,
 				NodeID:       node.ID,
 				NodeHostname: node.Description.Hostname,
-				IPv4:         ip,
+				Networks:     networks,
+				Slot:         task.Slot, // 0 for global services
+				ContainerID:  task.Status.ContainerStatus.ContainerID,
 			})
 		}
 
-		envs := map[string]string{}
-
-		for _, envSerialized := range dockerService.Spec.TaskTemplate.ContainerSpec.Env {
-			envKey, envVal := osutil.ParseEnv(envSerialized)
-			if envKey != "" {
-				envs[envKey] = envVal
-			}
-		}
-
 		services = append(services, Service{
 			Name:      dockerService.Spec.Name,
 			Image:     dockerService.Spec.TaskTemplate.ContainerSpec.Image,
+			Stack:     dockerService.Spec.Labels[stackNamespaceLabelKey],
+			Mode:      dockerService.Spec.Mode.name(),
 			ENVs:      envs,
+			Labels:    labels,
 			Instances: instances,
 		})
 	}
@@ -145,44 +376,50 @@ func listDockerServiceInstances(
 	return services, nil
 }
 
-func listDockerContainerInstances(
-	ctx context.Context,
-	dockerUrl string,
-	networkName string,
-	dockerClient *http.Client,
-) ([]Service, error) {
+func dockerContainersToServices(state dockerState, conf dockerDiscoveryConfig, skipped skipCounts) []Service {
 	services := []Service{}
 
-	containers := []udocker.ContainerListItem{}
-	if _, err := ezhttp.Get(
-		ctx,
-		dockerUrl+udocker.ListContainersEndpoint,
-		ezhttp.Client(dockerClient),
-		ezhttp.RespondsJsonAllowUnknownFields(&containers),
-	); err != nil {
-		return nil, err
-	}
-
-	for _, container := range containers {
+	for _, container := range state.containers {
 		if len(container.Names) == 0 {
 			continue
 		}
 
 		// these are already handled by more specific handler
-		if _, isSwarmService := container.Labels[udocker.SwarmServiceNameLabelKey]; isSwarmService {
+		if isSwarmTaskContainer(container) {
 			continue
 		}
 
-		ipAddress := ""
-		if settings, found := container.NetworkSettings.Networks[networkName]; found {
-			ipAddress = settings.IPAddress // prefer IP from the asked networkName
+		networks := []ServiceInstanceNetwork{}
+
+		// our networks in priority order, and then fall back to bridge
+		for _, networkName := range append(conf.networkNames, "bridge") {
+			settings, found := container.NetworkSettings.Networks[networkName]
+			if !found || len(settings.ips()) == 0 || serviceInstanceNetworksContain(networks, networkName) {
+				continue
+			}
+
+			networks = append(networks, ServiceInstanceNetwork{
+				Name: networkName,
+				IPs:  conf.addressFamily.sort(settings.ips()),
+			})
 		}
 
-		if settings, found := container.NetworkSettings.Networks["bridge"]; ipAddress == "" && found {
-			ipAddress = settings.IPAddress // fall back to bridge IP if not found
+		// we used to lie that labels are ENV vars (before we inspected containers for their
+		// real ENV vars), so keep accepting e.g. "METRICS_ENDPOINT" label for compatibility.
+		// real ENV vars win.
+		envs := map[string]string{}
+		for key, value := range container.Labels {
+			envs[key] = value
+		}
+		for key, value := range state.containerEnvs[container.Id] {
+			envs[key] = value
 		}
 
-		if ipAddress == "" {
+		if len(networks) == 0 {
+			// skips of containers that don't want to be scraped are uninteresting
+			if declaresEndpointSpecifier(Service{ENVs: envs, Labels: container.Labels}) {
+				skipped[skipReasonNoNetworkAttachment]++
+			}
 			continue
 		}
 
@@ -191,34 +428,75 @@ func listDockerContainerInstances(
 			serviceName = composeServiceName
 		}
 
-		// stupid Docker doesn't return ENV vars with ListContainers call, so let's lie that
-		// labels are ENV vars and inch closer to our goal of being able to specify metrics
-		// endpoint as a label (so, now labels only work for docker-compose or manually
-		// launched containers)
-		labelsAsEnvs := map[string]string{}
-		for key, value := range container.Labels {
-			labelsAsEnvs[key] = value
-		}
-
 		services = append(services, Service{
-			Name:  serviceName,
-			Image: container.Image,
-			ENVs:  labelsAsEnvs,
+			Name:   serviceName,
+			Image:  container.Image,
+			Stack:  container.Labels[composeProjectLabelKey],
+			ENVs:   envs,
+			Labels: container.Labels,
 			Instances: []ServiceInstance{
 				{
 					DockerTaskId: container.Id[0:12], // Docker ps uses 12 hexits
 					NodeID:       "dummy",
 					NodeHostname: "dummy",
-					IPv4:         ipAddress,
+					Networks:     networks,
+					ContainerID:  container.Id,
 				},
 			},
 		})
 	}
 
-	return services, nil
+	return services
 }
 
-func networkAttachmentForNetworkName(task udocker.Task, networkName string) *udocker.TaskNetworkAttachment {
+func isSwarmTaskContainer(container dockerContainer) bool {
+	_, isSwarmService := container.Labels[udocker.SwarmServiceNameLabelKey]
+	return isSwarmService
+}
+
+// ["FOO=bar"] => {"FOO": "bar"}
+func parseEnvs(envsSerialized []string) map[string]string {
+	envs := map[string]string{}
+
+	for _, envSerialized := range envsSerialized {
+		envKey, envVal := osutil.ParseEnv(envSerialized)
+		if envKey != "" {
+			envs[envKey] = envVal
+		}
+	}
+
+	return envs
+}
+
+func serviceInstanceNetworksContain(networks []ServiceInstanceNetwork, name string) bool {
+	for _, network := range networks {
+		if network.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// "monitoring, monitoring-staging" => ["monitoring", "monitoring-staging"]
+// "" => [] (i.e. not configured)
+func parseNetworkNames(serialized string) ([]string, error) {
+	networkNames := []string{}
+	for _, networkName := range strings.Split(serialized, ",") {
+		if networkName = strings.TrimSpace(networkName); networkName != "" {
+			networkNames = append(networkNames, networkName)
+		}
+	}
+
+	// e.g. "," or " " is most likely a templating mistake, and must not pass as not configured
+	if len(networkNames) == 0 && serialized != "" {
+		return nil, errors.New("no network names given")
+	}
+
+	return networkNames, nil
+}
+
+func networkAttachmentForNetworkName(task dockerTask, networkName string) *udocker.TaskNetworkAttachment {
 	for _, attachment := range task.NetworksAttachments {
 		if attachment.Network.Spec.Name == networkName {
 			return &attachment
@@ -237,3 +515,100 @@ func nodeById(id string, nodes []udocker.Node) *udocker.Node {
 
 	return nil
 }
+
+// "endpoint" is a low-cardinality name for the endpoint, used in metrics
+func dockerGetJson(
+	ctx context.Context,
+	endpoint string,
+	url string,
+	output interface{},
+	dockerClient *http.Client,
+) error {
+	started := time.Now()
+
+	_, err := ezhttp.Get(
+		ctx,
+		url,
+		ezhttp.Client(dockerClient),
+		ezhttp.RespondsJsonAllowUnknownFields(output))
+
+	dockerRequestDuration.WithLabelValues(endpoint).Observe(time.Since(started).Seconds())
+
+	// 404 is expected for inspecting a service or a node that was removed
+	if err != nil && !ezhttp.ErrorIs(err, http.StatusNotFound) {
+		dockerRequestErrors.WithLabelValues(endpoint).Inc()
+	}
+
+	return err
+}
+
+// preferred address family on dual-stack networks
+type addressFamily string
+
+const (
+	addressFamilyIPv4 addressFamily = "ipv4"
+	addressFamilyIPv6 addressFamily = "ipv6"
+)
+
+func parseAddressFamily(serialized string) (addressFamily, error) {
+	switch family := addressFamily(serialized); family {
+	case addressFamilyIPv4, addressFamilyIPv6:
+		return family, nil
+	default:
+		return "", fmt.Errorf("unknown address family: %s", serialized)
+	}
+}
+
+// returns IPs ordered so that those of the preferred family are first. "" prefers IPv4
+func (a addressFamily) sort(ips []string) []string {
+	preferred := func(ip string) bool {
+		isIPv4 := net.ParseIP(ip).To4() != nil
+		return isIPv4 == (a != addressFamilyIPv6)
+	}
+
+	sorted := append([]string{}, ips...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return preferred(sorted[i]) && !preferred(sorted[j])
+	})
+
+	return sorted
+}
+
+// set of Swarm task states whose tasks we consider scrapeable
+type taskStatePolicy map[string]bool
+
+// "running,starting" => {"running", "starting"}
+func parseTaskStatePolicy(serialized string) (taskStatePolicy, error) {
+	policy := taskStatePolicy{}
+
+	for _, state := range strings.Split(serialized, ",") {
+		if !stringSliceContains(taskStates, state) {
+			return nil, fmt.Errorf("unknown task state: %s", state)
+		}
+
+		policy[state] = true
+	}
+
+	return policy, nil
+}
+
+func (t taskStatePolicy) scrapeable(task dockerTask, job bool) bool {
+	// job's tasks want to run to completion. once they've completed, there's nothing to scrape
+	if job {
+		return task.DesiredState == taskStateComplete && task.Status.State != taskStateComplete && t[task.Status.State]
+	}
+
+	// desired state other than running means the task is going away (e.g. it was replaced
+	// in a rolling update) even though it might still be running
+	return task.DesiredState == taskStateRunning && t[task.Status.State]
+}
+
+func stringSliceContains(slice []string, item string) bool {
+	for _, sliceItem := range slice {
+		if sliceItem == item {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/function61/gokit/app/udocker"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestTaskStates(t *testing.T) {
+	// one task for each state
+	state := dockerState{
+		services: []dockerService{{ID: "svc1"}},
+		nodes:    []udocker.Node{{ID: "node1"}},
+	}
+
+	for _, taskState := range taskStates {
+		state.tasks = append(state.tasks, taskDef(taskState, taskState, taskStateRunning))
+	}
+
+	// shutdown desired even though the task is still running, e.g. in a rolling update
+	state.tasks = append(state.tasks, taskDef("shutdown-desired", taskStateRunning, taskStateShutdown))
+
+	scrapedTasks := func(t *testing.T, taskStatesSerialized string) string {
+		t.Helper()
+
+		policy, err := parseTaskStatePolicy(taskStatesSerialized)
+		assert.Ok(t, err)
+
+		services, _, err := dockerStateToServices(state, dockerDiscoveryConfig{
+			networkNames: []string{"monitoring"},
+			taskStates:   policy,
+		})
+		assert.Ok(t, err)
+
+		taskIds := []string{}
+		for _, instance := range services[0].Instances {
+			taskIds = append(taskIds, instance.DockerTaskId)
+		}
+
+		return strings.Join(taskIds, " ")
+	}
+
+	assert.EqualString(t, scrapedTasks(t, "running"), "running")
+	assert.EqualString(t, scrapedTasks(t, "running,starting"), "starting running")
+	assert.EqualString(t, scrapedTasks(t, "preparing,ready"), "preparing ready")
+
+	_, err := parseTaskStatePolicy("running,jogging")
+	assert.EqualString(t, err.Error(), "unknown task state: jogging")
+}
+
+func TestJobServiceTasks(t *testing.T) {
+	jobService := dockerService{ID: "svc1"}
+	jobService.Spec.Mode.ReplicatedJob = &struct{}{}
+
+	services, _, err := dockerStateToServices(dockerState{
+		services: []dockerService{jobService},
+		nodes:    []udocker.Node{{ID: "node1"}},
+		tasks: []dockerTask{
+			taskDef("running", taskStateRunning, taskStateComplete),
+			taskDef("completed", taskStateComplete, taskStateComplete),
+			taskDef("failed", taskStateFailed, taskStateComplete),
+		},
+	}, dockerDiscoveryConfig{
+		networkNames: []string{"monitoring"},
+		taskStates:   taskStatePolicy{taskStateRunning: true, taskStateComplete: true},
+	})
+	assert.Ok(t, err)
+
+	assert.EqualString(t, services[0].Mode, "replicated-job")
+	assert.Assert(t, len(services[0].Instances) == 1)
+	assert.EqualString(t, services[0].Instances[0].DockerTaskId, "running")
+}
+
+func TestSkipCounts(t *testing.T) {
+	noAttachment := taskDef("task2", taskStateRunning, taskStateRunning)
+	noAttachment.NetworksAttachments = nil
+
+	noIp := taskDef("task3", taskStateRunning, taskStateRunning)
+	noIp.NetworksAttachments[0].Addresses = nil
+
+	scraped := dockerService{ID: "svc1"}
+	scraped.Spec.TaskTemplate.ContainerSpec.Env = []string{"METRICS_ENDPOINT=/metrics"}
+
+	// doesn't want to be scraped => not on our network is expected, and not counted
+	notScraped := taskDef("task4", taskStateRunning, taskStateRunning)
+	notScraped.ServiceID = "svc2"
+	notScraped.NetworksAttachments = nil
+
+	services, skipped, err := dockerStateToServices(dockerState{
+		services: []dockerService{scraped, {ID: "svc2"}},
+		nodes:    []udocker.Node{{ID: "node1"}},
+		tasks: []dockerTask{
+			taskDef("task1", taskStateRunning, taskStateRunning),
+			noAttachment,
+			noIp,
+			notScraped,
+		},
+		containers: []dockerContainer{
+			onlyOnNetwork(containerDef("0123456789abcdef", map[string]string{"METRICS_ENDPOINT": "/metrics"}), "other"),
+			onlyOnNetwork(containerDef("fedcba9876543210", nil), "other"),
+		},
+	}, dockerDiscoveryConfig{
+		networkNames: []string{"monitoring"},
+		taskStates:   taskStatePolicy{taskStateRunning: true},
+	})
+	assert.Ok(t, err)
+
+	assert.Assert(t, len(services[0].Instances) == 1)
+	assert.EqualJson(t, skipped, `{
+  "no_ip": 1,
+  "no_network_attachment": 2
+}`)
+}
+
+func TestServiceLabelsOverrideContainerLabels(t *testing.T) {
+	service := dockerService{ID: "svc1"}
+	service.Spec.Labels = map[string]string{
+		"promswarmconnect.endpoint": "/service-level",
+	}
+	service.Spec.TaskTemplate.ContainerSpec.Labels = map[string]string{
+		"promswarmconnect.endpoint":  "/container-level",
+		"promswarmconnect.endpoint2": "/container-level2",
+	}
+
+	services, _, err := dockerStateToServices(dockerState{
+		services: []dockerService{service},
+	}, dockerDiscoveryConfig{networkNames: []string{"monitoring"}})
+	assert.Ok(t, err)
+
+	assert.EqualJson(t, services[0].Labels, `{
+  "promswarmconnect.endpoint": "/service-level",
+  "promswarmconnect.endpoint2": "/container-level2"
+}`)
+}
+
+func TestStandaloneContainerEnvs(t *testing.T) {
+	container := containerDef("0123456789abcdef", map[string]string{
+		"METRICS_ENDPOINT":          "/from-label", // legacy labels-as-ENVs
+		"METRICS_OVERRIDE_INSTANCE": "foo",
+	})
+
+	services, _, err := dockerStateToServices(dockerState{
+		containers: []dockerContainer{container},
+		containerEnvs: map[string]map[string]string{
+			"0123456789abcdef": {"METRICS_ENDPOINT": "/from-env"},
+		},
+	}, dockerDiscoveryConfig{networkNames: []string{"monitoring"}})
+	assert.Ok(t, err)
+
+	assert.EqualJson(t, services[0].ENVs, `{
+  "METRICS_ENDPOINT": "/from-env",
+  "METRICS_OVERRIDE_INSTANCE": "foo"
+}`)
+}
+
+func TestInspectContainerEnvs(t *testing.T) {
+	inspects := int32(0)
+
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&inspects, 1)
+
+		if r.URL.Path == "/v1.24/containers/removed/json" {
+			http.NotFound(w, r)
+			return
+		}
+
+		container := udocker.Container{}
+		container.Config.Env = []string{"METRICS_ENDPOINT=/metrics", "FOO=bar"}
+		assert.Ok(t, json.NewEncoder(w).Encode(container))
+	}))
+	defer docker.Close()
+
+	containers := []dockerContainer{
+		containerDef("new", nil),
+		containerDef("known", nil),
+		containerDef("removed", nil),
+		containerDef("swarmtask", map[string]string{udocker.SwarmServiceNameLabelKey: "svc"}),
+	}
+
+	envs, err := inspectContainerEnvs(context.Background(), docker.URL, containers, map[string]map[string]string{
+		"known":   {"CACHED": "yes"},
+		"stopped": {"CACHED": "yes"}, // not in list anymore => dropped
+	}, docker.Client())
+	assert.Ok(t, err)
+
+	assert.Assert(t, atomic.LoadInt32(&inspects) == 2) // "new" and "removed"
+	assert.EqualJson(t, envs, `{
+  "known": {
+    "CACHED": "yes"
+  },
+  "new": {
+    "FOO": "bar",
+    "METRICS_ENDPOINT": "/metrics"
+  }
+}`)
+}
+
+func TestFetchDockerStateNotSwarmManager(t *testing.T) {
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.24/info":
+			_, _ = w.Write([]byte(`{"Swarm": {"LocalNodeState": "inactive", "ControlAvailable": false}}`))
+		case "/v1.24/containers/json":
+			_, _ = w.Write([]byte(`[{"Id": "0123456789abcdef", "Names": ["/hellohttp"], "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2", "GlobalIPv6Address": "fd00::2"}}}}]`))
+		case "/v1.24/containers/0123456789abcdef/json":
+			_, _ = w.Write([]byte(`{"Config": {"Env": ["METRICS_ENDPOINT=/metrics"]}}`))
+		default: // Swarm endpoints fail on non-managers
+			http.Error(w, "This node is not a swarm manager.", http.StatusServiceUnavailable)
+		}
+	}))
+	defer docker.Close()
+
+	state, err := fetchDockerState(context.Background(), docker.URL, docker.Client(), nil)
+	assert.Ok(t, err)
+
+	assert.Assert(t, len(state.containers) == 1)
+	assert.EqualString(t, strings.Join(state.containers[0].NetworkSettings.Networks["bridge"].ips(), " "), "172.17.0.2 fd00::2")
+	assert.EqualJson(t, dockerStateToStatus(*state, dockerDiscoveryConfig{networkNames: []string{"monitoring"}}), `{
+  "swarm_node_state": "inactive",
+  "swarm_manager": false,
+  "sources": [
+    "containers"
+  ],
+  "networks": [
+    "monitoring"
+  ]
+}`)
+}
+
+func TestFetchDockerStateInfoNotAllowed(t *testing.T) {
+	// proxy that allows what we needed before we asked /info
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.24/info":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		case "/v1.24/services":
+			_, _ = w.Write([]byte(`[{"ID": "svc1", "Spec": {"Name": "hellohttp"}}]`))
+		default:
+			_, _ = w.Write([]byte(`[]`))
+		}
+	}))
+	defer docker.Close()
+
+	state, err := fetchDockerState(context.Background(), docker.URL, docker.Client(), nil)
+	assert.Ok(t, err)
+
+	assert.Assert(t, len(state.services) == 1)
+	assert.EqualJson(t, dockerStateToStatus(*state, dockerDiscoveryConfig{networkNames: []string{"monitoring"}}), `{
+  "swarm_node_state": "unknown",
+  "swarm_manager": false,
+  "sources": [
+    "swarm_services",
+    "containers"
+  ],
+  "networks": [
+    "monitoring"
+  ]
+}`)
+}
+
+func TestAddressFamily(t *testing.T) {
+	task := taskDef("task1", taskStateRunning, taskStateRunning)
+	task.NetworksAttachments[0].Addresses = []string{"10.0.0.2/24", "fd00::2/64"}
+
+	instanceAddress := func(t *testing.T, family addressFamily) string {
+		t.Helper()
+
+		services, _, err := dockerStateToServices(dockerState{
+			services: []dockerService{{ID: "svc1"}},
+			nodes:    []udocker.Node{{ID: "node1"}},
+			tasks:    []dockerTask{task},
+		}, dockerDiscoveryConfig{
+			networkNames:  []string{"monitoring"},
+			taskStates:    taskStatePolicy{taskStateRunning: true},
+			addressFamily: family,
+		})
+		assert.Ok(t, err)
+
+		services[0].ENVs = map[string]string{"METRICS_ENDPOINT": "/metrics"}
+
+		return serviceToMetricsEndpoints(services, "")[0].Address
+	}
+
+	assert.EqualString(t, instanceAddress(t, ""), "10.0.0.2:80")
+	assert.EqualString(t, instanceAddress(t, addressFamilyIPv4), "10.0.0.2:80")
+	assert.EqualString(t, instanceAddress(t, addressFamilyIPv6), "[fd00::2]:80")
+
+	// IPv6-only network
+	task.NetworksAttachments[0].Addresses = []string{"fd00::2/64"}
+
+	assert.EqualString(t, instanceAddress(t, addressFamilyIPv4), "[fd00::2]:80")
+
+	_, err := parseAddressFamily("ipv5")
+	assert.EqualString(t, err.Error(), "unknown address family: ipv5")
+}
+
+func TestNetworkPriority(t *testing.T) {
+	task := taskDef("task1", taskStateRunning, taskStateRunning)
+	task.NetworksAttachments = append(task.NetworksAttachments, udocker.TaskNetworkAttachment{
+		Network: udocker.TaskNetworkAttachmentNetwork{
+			Spec: udocker.TaskNetworkAttachmentNetworkSpec{Name: "monitoring-staging"},
+		},
+		Addresses: []string{"10.1.0.2/24"},
+	})
+
+	addresses := func(t *testing.T, networkNamesSerialized string, specifier string) string {
+		t.Helper()
+
+		networkNames, err := parseNetworkNames(networkNamesSerialized)
+		assert.Ok(t, err)
+
+		services, _, err := dockerStateToServices(dockerState{
+			services: []dockerService{{ID: "svc1"}},
+			nodes:    []udocker.Node{{ID: "node1"}},
+			tasks:    []dockerTask{task},
+		}, dockerDiscoveryConfig{
+			networkNames: networkNames,
+			taskStates:   taskStatePolicy{taskStateRunning: true},
+		})
+		assert.Ok(t, err)
+
+		services[0].ENVs = map[string]string{"METRICS_ENDPOINT": specifier}
+
+		endpoints, rejected := serviceToMetricsEndpointsAndRejections(services, "")
+		if len(rejected) > 0 {
+			return rejected[0].Error
+		}
+
+		addresses := []string{}
+		for _, endpoint := range endpoints {
+			addresses = append(addresses, endpoint.Address)
+		}
+
+		return strings.Join(addresses, " ")
+	}
+
+	assert.EqualString(t, addresses(t, "monitoring, monitoring-staging", "/metrics"), "10.0.0.2:80")
+	assert.EqualString(t, addresses(t, "monitoring-staging,monitoring", "/metrics"), "10.1.0.2:80")
+	assert.EqualString(t, addresses(t, "nonexistent,monitoring-staging", "/metrics"), "10.1.0.2:80")
+	assert.EqualString(t, addresses(t, "monitoring,monitoring-staging", "/metrics,network=monitoring-staging"), "10.1.0.2:80")
+	assert.EqualString(t, addresses(t, "monitoring", "/metrics,network=monitoring-staging"), "network: no tasks on network monitoring-staging that we scrape")
+	assert.EqualString(t, addresses(t, "monitoring", "/metrics,network=monitoring-stagign"), "network: no tasks on network monitoring-stagign that we scrape")
+
+	_, err := parseNetworkNames(" , ")
+	assert.EqualString(t, err.Error(), "no network names given")
+}
+
+func containerDef(id string, labels map[string]string) dockerContainer {
+	container := dockerContainer{}
+	container.Id = id
+	container.Names = []string{"/hellohttp"}
+	container.Labels = labels
+	container.NetworkSettings.Networks = map[string]dockerContainerNetwork{
+		"bridge": {IPAddress: "172.17.0.2"},
+	}
+	return container
+}
+
+func onlyOnNetwork(container dockerContainer, networkName string) dockerContainer {
+	container.NetworkSettings.Networks = map[string]dockerContainerNetwork{
+		networkName: {IPAddress: "10.9.0.2"},
+	}
+	return container
+}
+
+func taskDef(id string, state string, desiredState string) dockerTask {
+	return dockerTask{
+		Task: udocker.Task{
+			ID:        id,
+			ServiceID: "svc1",
+			NodeID:    "node1",
+			NetworksAttachments: []udocker.TaskNetworkAttachment{
+				{
+					Network: udocker.TaskNetworkAttachmentNetwork{
+						Spec: udocker.TaskNetworkAttachmentNetworkSpec{Name: "monitoring"},
+					},
+					Addresses: []string{"10.0.0.2/24"},
+				},
+			},
+		},
+		DesiredState: desiredState,
+		Status:       dockerTaskStatus{State: state},
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/function61/gokit/app/udocker"
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/net/http/ezhttp"
+)
+
+const (
+	// bursts of events (think rolling update) are coalesced into fewer Docker API calls
+	eventCoalesceDelay = 1 * time.Second
+	syncRetryDelay     = 5 * time.Second
+)
+
+// keeps an in-memory model of Docker state so we don't have to hammer Docker's API on each
+// discovery request. does an initial full sync and then follows Docker's events stream to
+// update the model incrementally. events don't tell us about everything (e.g. we only get
+// container events for the node we're connected to, and task state changes in general are
+// not evented), so we also do periodic full resyncs as a safety net.
+type dockerDiscoveryCache struct {
+	dockerUrl      string
+	conf           dockerDiscoveryConfig
+	dockerClient   *http.Client
+	resyncInterval time.Duration
+	maxStaleness   time.Duration
+	logl           *logex.Leveled
+
+	snapshotMu sync.Mutex
+	snapshot   *discoverySnapshot // nil before initial sync
+	refreshErr error              // non-nil if most recent refresh attempt failed
+
+	loggedRejections map[RejectedEndpointSpecifier]bool // only accessed from Run()
+	containerEnvs    map[string]map[string]string       // only accessed from Run()
+}
+
+func newDockerDiscoveryCache(
+	dockerUrl string,
+	conf dockerDiscoveryConfig,
+	dockerClient *http.Client,
+	resyncInterval time.Duration,
+	maxStaleness time.Duration,
+	logger *log.Logger,
+) *dockerDiscoveryCache {
+	return &dockerDiscoveryCache{
+		dockerUrl:      dockerUrl,
+		conf:           conf,
+		dockerClient:   dockerClient,
+		resyncInterval: resyncInterval,
+		maxStaleness:   maxStaleness,
+		logl:           logex.Levels(logger),
+	}
+}
+
+// satisfies discoverFn. if Docker is unavailable, we keep serving the last-known-good
+// services (so a manager leader election doesn't wipe out all targets) until they're older
+// than maxStaleness.
+func (c *dockerDiscoveryCache) Discover(_ context.Context) (*discoverySnapshot, error) {
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+
+	if c.snapshot == nil {
+		if c.refreshErr != nil {
+			return nil, fmt.Errorf("initial sync with Docker not completed yet: %w", c.refreshErr)
+		}
+
+		return nil, errors.New("initial sync with Docker not completed yet")
+	}
+
+	if age := time.Since(c.snapshot.refreshedAt); c.refreshErr != nil && age > c.maxStaleness {
+		return nil, fmt.Errorf(
+			"services last refreshed %s ago (max staleness %s): %w",
+			age.Truncate(time.Second),
+			c.maxStaleness,
+			c.refreshErr)
+	}
+
+	statuses := []DiscoveryStatus{}
+	for _, status := range c.snapshot.statuses {
+		if c.refreshErr != nil {
+			status.Error = c.refreshErr.Error()
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return &discoverySnapshot{
+		services:    c.snapshot.services,
+		rejected:    c.snapshot.rejected,
+		skipped:     c.snapshot.skipped,
+		statuses:    statuses,
+		refreshedAt: c.snapshot.refreshedAt,
+		refreshErr:  c.refreshErr,
+
+		jobNameStrategy: c.snapshot.jobNameStrategy,
+	}, nil
+}
+
+func (c *dockerDiscoveryCache) Run(ctx context.Context) error {
+	for {
+		err := c.syncAndFollowEvents(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		c.logl.Error.Printf("%v; starting over in %s", err, syncRetryDelay)
+
+		c.snapshotMu.Lock()
+		c.refreshErr = err
+		c.snapshotMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(syncRetryDelay):
+		}
+	}
+}
+
+// does a full sync and then keeps the model up-to-date from the events stream. returns only
+// on errors (or ctx cancellation), after which the caller is expected to start over
+func (c *dockerDiscoveryCache) syncAndFollowEvents(ctx context.Context) error {
+	eventsCtx, cancelEvents := context.WithCancel(ctx)
+	defer cancelEvents()
+
+	// subscribe before the full sync so we don't miss changes that happen in between.
+	// events are only an optimization over the resyncs, so if Docker (or a filtering proxy in
+	// front of it) refuses them, we get by with resyncs. nil channels are never ready.
+	events, eventsErr, err := c.subscribeEvents(eventsCtx)
+	if err != nil {
+		c.logl.Error.Printf(
+			"subscribeEvents: %v; only refreshing every %s",
+			err,
+			c.resyncInterval)
+	}
+
+	state, err := c.fullSync(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.logl.Info.Printf("synced %d service(s), %d container(s)", len(state.services), len(state.containers))
+
+	resync := time.NewTicker(c.resyncInterval)
+	defer resync.Stop()
+
+	changes := newDockerStateChanges()
+	var applyChanges <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-eventsErr:
+			return fmt.Errorf("events: %w", err)
+		case event := <-events:
+			changes.add(event)
+
+			if applyChanges == nil {
+				applyChanges = time.After(eventCoalesceDelay)
+			}
+		case <-applyChanges:
+			applyChanges = nil
+
+			if err := c.applyChanges(ctx, state, changes); err != nil {
+				return fmt.Errorf("applyChanges: %w", err)
+			}
+
+			changes = newDockerStateChanges()
+		case <-resync.C:
+			state, err = c.fullSync(ctx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *dockerDiscoveryCache) fullSync(ctx context.Context) (*dockerState, error) {
+	state, err := fetchDockerState(ctx, c.dockerUrl, c.dockerClient, c.containerEnvs)
+	if err != nil {
+		return nil, fmt.Errorf("fullSync: %w", err)
+	}
+
+	c.containerEnvs = state.containerEnvs
+
+	return state, c.publish(*state)
+}
+
+func (c *dockerDiscoveryCache) applyChanges(
+	ctx context.Context,
+	state *dockerState,
+	changes *dockerStateChanges,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, ezhttp.DefaultTimeout10s)
+	defer cancel()
+
+	// on a Swarm worker we get container events for Swarm tasks, but can't inspect their
+	// services. if we get promoted to a manager, the next full sync notices.
+	if !state.info.useSwarmApis() {
+		changes.services = map[string]bool{}
+		changes.nodes = map[string]bool{}
+	}
+
+	for serviceId := range changes.services {
+		service := dockerService{}
+		err := dockerGetJson(ctx, "service_inspect", c.dockerUrl+dockerServiceInspectEndpoint(serviceId), &service, c.dockerClient)
+		switch {
+		case ezhttp.ErrorIs(err, http.StatusNotFound):
+			state.removeService(serviceId)
+		case err != nil:
+			return err
+		default:
+			tasks := []dockerTask{}
+			if err := dockerGetJson(ctx, "service_tasks", c.dockerUrl+dockerTasksForServiceEndpointByMode(service), &tasks, c.dockerClient); err != nil {
+				return err
+			}
+
+			state.putService(service, tasks)
+		}
+	}
+
+	for nodeId := range changes.nodes {
+		node := udocker.Node{}
+		err := dockerGetJson(ctx, "node_inspect", c.dockerUrl+dockerNodeInspectEndpoint(nodeId), &node, c.dockerClient)
+		switch {
+		case ezhttp.ErrorIs(err, http.StatusNotFound):
+			state.removeNode(nodeId)
+		case err != nil:
+			return err
+		default:
+			state.putNode(node)
+		}
+	}
+
+	if changes.containers {
+		containers := []dockerContainer{}
+		if err := dockerGetJson(ctx, "containers", c.dockerUrl+udocker.ListContainersEndpoint, &containers, c.dockerClient); err != nil {
+			return err
+		}
+
+		containerEnvs, err := inspectContainerEnvs(ctx, c.dockerUrl, containers, state.containerEnvs, c.dockerClient)
+		if err != nil {
+			return err
+		}
+
+		state.containers = containers
+		state.containerEnvs = containerEnvs
+		c.containerEnvs = containerEnvs
+	}
+
+	return c.publish(*state)
+}
+
+// makes the state visible to discovery requests
+func (c *dockerDiscoveryCache) publish(state dockerState) error {
+	services, skipped, err := dockerStateToServices(state, c.conf)
+	if err != nil {
+		return err
+	}
+
+	_, rejected := serviceToMetricsEndpointsAndRejections(services, c.conf.jobNameStrategy)
+
+	c.logNewRejections(rejected)
+
+	status := dockerStateToStatus(state, c.conf)
+
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+
+	// only log when they change (e.g. node got promoted to a manager)
+	sourcesChanged := c.snapshot == nil || len(c.snapshot.statuses) == 0 ||
+		c.snapshot.statuses[0].SwarmNodeState != status.SwarmNodeState ||
+		c.snapshot.statuses[0].SwarmManager != status.SwarmManager
+
+	if sourcesChanged {
+		c.logl.Info.Printf(
+			"discovery sources: %s (Swarm node state: %s, manager: %v)",
+			strings.Join(status.Sources, ", "),
+			status.SwarmNodeState,
+			status.SwarmManager)
+	}
+
+	c.snapshot = &discoverySnapshot{
+		services:    services,
+		rejected:    rejected,
+		skipped:     skipped,
+		statuses:    []DiscoveryStatus{status},
+		refreshedAt: time.Now(),
+
+		jobNameStrategy: c.conf.jobNameStrategy,
+	}
+	c.refreshErr = nil
+
+	return nil
+}
+
+// we publish often, so to not spam the log we only log each rejection when it first appears
+func (c *dockerDiscoveryCache) logNewRejections(rejected []RejectedEndpointSpecifier) {
+	current := map[RejectedEndpointSpecifier]bool{}
+
+	for _, rejection := range rejected {
+		current[rejection] = true
+
+		if !c.loggedRejections[rejection] {
+			c.logl.Error.Printf(
+				"service %s: ignoring %s=%s: %s",
+				rejection.Service,
+				rejection.Key,
+				rejection.Value,
+				rejection.Error)
+		}
+	}
+
+	c.loggedRejections = current
+}
+
+func (c *dockerDiscoveryCache) subscribeEvents(ctx context.Context) (<-chan dockerEvent, <-chan error, error) {
+	// no timeout, because this is a stream that lives as long as ctx does
+	resp, err := ezhttp.Get(
+		ctx,
+		c.dockerUrl+dockerEventsEndpoint,
+		ezhttp.Client(c.dockerClient))
+	if err != nil {
+		dockerRequestErrors.WithLabelValues("events").Inc()
+		return nil, nil, err
+	}
+
+	events := make(chan dockerEvent)
+	eventsErr := make(chan error, 1)
+
+	go func() {
+		defer resp.Body.Close()
+
+		eventDecoder := json.NewDecoder(resp.Body)
+
+		for {
+			event := dockerEvent{}
+			if err := eventDecoder.Decode(&event); err != nil {
+				eventsErr <- err
+				return
+			}
+
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, eventsErr, nil
+}
+
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// accumulates what needs to be refreshed from Docker, as learned from events
+type dockerStateChanges struct {
+	services   map[string]bool // service IDs whose spec and tasks to refresh
+	nodes      map[string]bool // node IDs
+	containers bool            // standalone container list
+}
+
+func newDockerStateChanges() *dockerStateChanges {
+	return &dockerStateChanges{
+		services: map[string]bool{},
+		nodes:    map[string]bool{},
+	}
+}
+
+func (d *dockerStateChanges) add(event dockerEvent) {
+	switch event.Type {
+	case "service":
+		d.services[event.Actor.ID] = true
+	case "node":
+		d.nodes[event.Actor.ID] = true
+	case "container":
+		// a Swarm task's container started or died. we only get these for the node we're
+		// connected to, but it's better than nothing
+		if serviceId := event.Actor.Attributes["com.docker.swarm.service.id"]; serviceId != "" {
+			d.services[serviceId] = true
+		} else {
+			d.containers = true
+		}
+	}
+}
+
+// replaces (or adds) service and its tasks. replaces in-place to keep ordering stable.
+func (s *dockerState) putService(service dockerService, tasks []dockerTask) {
+	otherServicesTasks := []dockerTask{}
+	for _, task := range s.tasks {
+		if task.ServiceID != service.ID {
+			otherServicesTasks = append(otherServicesTasks, task)
+		}
+	}
+
+	s.tasks = append(otherServicesTasks, tasks...)
+
+	for idx := range s.services {
+		if s.services[idx].ID == service.ID {
+			s.services[idx] = service
+			return
+		}
+	}
+
+	s.services = append(s.services, service)
+}
+
+func (s *dockerState) removeService(serviceId string) {
+	services := []dockerService{}
+	for _, service := range s.services {
+		if service.ID != serviceId {
+			services = append(services, service)
+		}
+	}
+
+	tasks := []dockerTask{}
+	for _, task := range s.tasks {
+		if task.ServiceID != serviceId {
+			tasks = append(tasks, task)
+		}
+	}
+
+	s.services = services
+	s.tasks = tasks
+}
+
+func (s *dockerState) putNode(node udocker.Node) {
+	for idx := range s.nodes {
+		if s.nodes[idx].ID == node.ID {
+			s.nodes[idx] = node
+			return
+		}
+	}
+
+	s.nodes = append(s.nodes, node)
+}
+
+func (s *dockerState) removeNode(nodeId string) {
+	nodes := []udocker.Node{}
+	for _, node := range s.nodes {
+		if node.ID != nodeId {
+			nodes = append(nodes, node)
+		}
+	}
+
+	s.nodes = nodes
+}
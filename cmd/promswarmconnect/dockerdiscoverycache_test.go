@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/app/udocker"
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestDockerStateChanges(t *testing.T) {
+	event := func(typ string, id string, attributes map[string]string) dockerEvent {
+		e := dockerEvent{Type: typ}
+		e.Actor.ID = id
+		e.Actor.Attributes = attributes
+		return e
+	}
+
+	changes := newDockerStateChanges()
+	changes.add(event("service", "svc1", nil))
+	changes.add(event("node", "node1", nil))
+	changes.add(event("container", "abc", map[string]string{
+		"com.docker.swarm.service.id": "svc2",
+	}))
+
+	assert.Assert(t, changes.services["svc1"] && changes.services["svc2"] && len(changes.services) == 2)
+	assert.Assert(t, changes.nodes["node1"] && len(changes.nodes) == 1)
+	assert.Assert(t, !changes.containers)
+
+	changes.add(event("container", "def", map[string]string{}))
+
+	assert.Assert(t, changes.containers)
+}
+
+func TestDockerStatePutAndRemoveService(t *testing.T) {
+	state := &dockerState{
+		services: []dockerService{{ID: "svc1"}, {ID: "svc2"}},
+		tasks: []dockerTask{
+			serviceTask("task1", "svc1"),
+			serviceTask("task2", "svc2"),
+			serviceTask("task3", "svc1"),
+		},
+	}
+
+	// replaces tasks, but keeps service ordering
+	state.putService(dockerService{ID: "svc1"}, []dockerTask{serviceTask("task4", "svc1")})
+
+	assert.EqualString(t, serviceAndTaskIds(*state), "svc1 svc2 | task2 task4")
+
+	state.putService(dockerService{ID: "svc3"}, []dockerTask{serviceTask("task5", "svc3")})
+
+	assert.EqualString(t, serviceAndTaskIds(*state), "svc1 svc2 svc3 | task2 task4 task5")
+
+	state.removeService("svc2")
+
+	assert.EqualString(t, serviceAndTaskIds(*state), "svc1 svc3 | task4 task5")
+}
+
+func serviceTask(id string, serviceId string) dockerTask {
+	return dockerTask{Task: udocker.Task{ID: id, ServiceID: serviceId}}
+}
+
+func serviceAndTaskIds(state dockerState) string {
+	ids := []string{}
+	for _, service := range state.services {
+		ids = append(ids, service.ID)
+	}
+
+	ids = append(ids, "|")
+
+	for _, task := range state.tasks {
+		ids = append(ids, task.ID)
+	}
+
+	return strings.Join(ids, " ")
+}
+
+func TestDockerDiscoveryCacheServesLastKnownGood(t *testing.T) {
+	cache := newDockerDiscoveryCache("", dockerDiscoveryConfig{}, nil, time.Minute, 5*time.Minute, logex.Discard)
+
+	_, err := cache.Discover(context.Background())
+	assert.EqualString(t, err.Error(), "initial sync with Docker not completed yet")
+
+	cache.snapshot = &discoverySnapshot{
+		services:    []Service{serviceDef(nil, inst1)},
+		refreshedAt: time.Now().Add(-4 * time.Minute),
+	}
+	cache.refreshErr = errors.New("manager unavailable")
+
+	snapshot, err := cache.Discover(context.Background())
+	assert.Ok(t, err)
+	assert.Assert(t, len(snapshot.services) == 1)
+	assert.EqualString(t, snapshot.refreshErr.Error(), "manager unavailable")
+
+	cache.snapshot.refreshedAt = time.Now().Add(-6 * time.Minute)
+
+	_, err = cache.Discover(context.Background())
+	assert.EqualString(t, err.Error(), "services last refreshed 6m0s ago (max staleness 5m0s): manager unavailable")
+}
+
+func TestDockerDiscoveryCacheServesJobNameStrategy(t *testing.T) {
+	cache := newDockerDiscoveryCache("", dockerDiscoveryConfig{
+		networkNames:    []string{"monitoring"},
+		taskStates:      taskStatePolicy{taskStateRunning: true},
+		jobNameStrategy: jobNameStrategyServiceWithoutStack,
+	}, nil, time.Minute, 5*time.Minute, logex.Discard)
+
+	service := dockerService{ID: "svc1"}
+	service.Spec.Name = "hello_hellohttp"
+	service.Spec.Labels = map[string]string{stackNamespaceLabelKey: "hello"}
+	service.Spec.TaskTemplate.ContainerSpec.Env = []string{"METRICS_ENDPOINT=/metrics"}
+
+	assert.Ok(t, cache.publish(dockerState{
+		services: []dockerService{service},
+		nodes:    []udocker.Node{{ID: "node1"}},
+		tasks:    []dockerTask{taskDef("task1", taskStateRunning, taskStateRunning)},
+	}))
+
+	mux := http.NewServeMux()
+	registerTritonDiscoveryApi(mux, cache.Discover)
+
+	res := httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/v1/http_sd", nil))
+
+	targetGroups := []HttpSdTargetGroup{}
+	assert.Ok(t, json.Unmarshal(res.Body.Bytes(), &targetGroups))
+	assert.Assert(t, len(targetGroups) == 1)
+	assert.EqualString(t, targetGroups[0].Labels["job"], "hellohttp")
+}
+
+func TestDockerDiscoveryCacheWithoutEvents(t *testing.T) {
+	// proxy that only allows what the non-cached version used to need
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.24/info":
+			_, _ = w.Write([]byte(`{"Swarm": {"LocalNodeState": "inactive", "ControlAvailable": false}}`))
+		case "/v1.24/containers/json":
+			_, _ = w.Write([]byte(`[{"Id": "0123456789abcdef", "Names": ["/hellohttp"], "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2"}}}}]`))
+		case "/v1.24/containers/0123456789abcdef/json":
+			_, _ = w.Write([]byte(`{"Config": {"Env": ["METRICS_ENDPOINT=/metrics"]}}`))
+		default:
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+	}))
+	defer docker.Close()
+
+	cache := newDockerDiscoveryCache(docker.URL, dockerDiscoveryConfig{
+		networkNames: []string{"monitoring"},
+	}, docker.Client(), time.Minute, 5*time.Minute, logex.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = cache.Run(ctx)
+	}()
+
+	// initial sync should succeed even though events are not available
+	for i := 0; ; i++ {
+		snapshot, err := cache.Discover(ctx)
+		if err == nil {
+			assert.Assert(t, len(snapshot.services) == 1)
+			break
+		}
+
+		if i == 100 {
+			t.Fatalf("no snapshot: %v", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/url"
+)
+
+// endpoints not provided by udocker
+
+// service & node events are only available from API v1.30 onwards.
+// the "event" filter matches actions of all types, so this is the union of interesting actions.
+var dockerEventsEndpoint = "/v1.30/events?filters=" + url.QueryEscape(`{"type":["service","node","container"],"event":["create","update","remove","start","die","rename"]}`)
+
+const dockerInfoEndpoint = "/v1.24/info"
+
+func dockerServiceInspectEndpoint(serviceId string) string {
+	return "/v1.24/services/" + serviceId
+}
+
+func dockerNodeInspectEndpoint(nodeId string) string {
+	return "/v1.24/nodes/" + nodeId
+}
+
+// same as udocker.TasksEndpoint, but only for one service
+func dockerTasksForServiceEndpoint(serviceId string) string {
+	return "/v1.24/tasks?filters=" + url.QueryEscape(`{"desired-state":["running"],"service":["`+serviceId+`"]}`)
+}
+
+// job's tasks' desired state is "complete" (and not "running"), so they need a separate query
+func dockerJobTasksForServiceEndpoint(serviceId string) string {
+	return "/v1.24/tasks?filters=" + url.QueryEscape(`{"service":["`+serviceId+`"]}`)
+}
+
+func dockerTasksForServiceEndpointByMode(service dockerService) string {
+	if service.Spec.Mode.job() {
+		return dockerJobTasksForServiceEndpoint(service.ID)
+	}
+
+	return dockerTasksForServiceEndpoint(service.ID)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"github.com/function61/gokit/app/udocker"
+)
+
+const (
+	stackNamespaceLabelKey = "com.docker.stack.namespace"
+	composeProjectLabelKey = "com.docker.compose.project"
+)
+
+// same as "$ docker service ls" shows
+const (
+	serviceModeReplicated    = "replicated"
+	serviceModeGlobal        = "global"
+	serviceModeReplicatedJob = "replicated-job"
+	serviceModeGlobalJob     = "global-job"
+)
+
+// https://docs.docker.com/engine/swarm/how-swarm-mode-works/swarm-task-states/
+const (
+	taskStateNew       = "new"
+	taskStateAllocated = "allocated"
+	taskStatePending   = "pending"
+	taskStateAssigned  = "assigned"
+	taskStateAccepted  = "accepted"
+	taskStatePreparing = "preparing"
+	taskStateReady     = "ready"
+	taskStateStarting  = "starting"
+	taskStateRunning   = "running"
+	taskStateComplete  = "complete"
+	taskStateShutdown  = "shutdown"
+	taskStateFailed    = "failed"
+	taskStateRejected  = "rejected"
+	taskStateRemove    = "remove"
+	taskStateOrphaned  = "orphaned"
+)
+
+var taskStates = []string{
+	taskStateNew,
+	taskStateAllocated,
+	taskStatePending,
+	taskStateAssigned,
+	taskStateAccepted,
+	taskStatePreparing,
+	taskStateReady,
+	taskStateStarting,
+	taskStateRunning,
+	taskStateComplete,
+	taskStateShutdown,
+	taskStateFailed,
+	taskStateRejected,
+	taskStateRemove,
+	taskStateOrphaned,
+}
+
+// not provided by udocker
+
+type dockerInfo struct {
+	Swarm dockerInfoSwarm `json:"Swarm"`
+}
+
+type dockerInfoSwarm struct {
+	LocalNodeState   string `json:"LocalNodeState"` // "inactive", "pending", "active", "error", "locked"
+	ControlAvailable bool   `json:"ControlAvailable"`
+}
+
+// LocalNodeState if we couldn't ask Docker (e.g. a proxy doesn't allow /info)
+const swarmNodeStateUnknown = "unknown"
+
+// only managers can list Swarm services, tasks and nodes
+func (d dockerInfo) swarmManager() bool {
+	return d.Swarm.LocalNodeState == "active" && d.Swarm.ControlAvailable
+}
+
+// if we don't know whether we're talking to a manager, we try anyway (like we did before
+// asking)
+func (d dockerInfo) useSwarmApis() bool {
+	return d.swarmManager() || d.Swarm.LocalNodeState == swarmNodeStateUnknown
+}
+
+// udocker's structs extended with fields we need
+
+type dockerContainer struct {
+	udocker.ContainerListItem
+	NetworkSettings struct { // shadows the embedded one
+		Networks map[string]dockerContainerNetwork `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+type dockerContainerNetwork struct {
+	IPAddress         string `json:"IPAddress"`
+	GlobalIPv6Address string `json:"GlobalIPv6Address"`
+}
+
+func (d dockerContainerNetwork) ips() []string {
+	ips := []string{}
+	for _, ip := range []string{d.IPAddress, d.GlobalIPv6Address} {
+		if ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips
+}
+
+type dockerTask struct {
+	udocker.Task
+	Slot         int              `json:"Slot"` // only for replicated services
+	DesiredState string           `json:"DesiredState"`
+	Status       dockerTaskStatus `json:"Status"`
+}
+
+type dockerTaskStatus struct {
+	State           string `json:"State"`
+	ContainerStatus struct {
+		ContainerID string `json:"ContainerID"`
+	} `json:"ContainerStatus"`
+}
+
+type dockerService struct {
+	ID   string            `json:"ID"`
+	Spec dockerServiceSpec `json:"Spec"`
+}
+
+type dockerServiceSpec struct {
+	Name         string                    `json:"Name"`
+	Labels       map[string]string         `json:"Labels"`
+	TaskTemplate dockerServiceTaskTemplate `json:"TaskTemplate"`
+	Mode         dockerServiceMode         `json:"Mode"`
+}
+
+// exactly one is set. jobs need Docker 20.10+
+type dockerServiceMode struct {
+	Replicated    *struct{} `json:"Replicated"`
+	Global        *struct{} `json:"Global"`
+	ReplicatedJob *struct{} `json:"ReplicatedJob"`
+	GlobalJob     *struct{} `json:"GlobalJob"`
+}
+
+func (d dockerServiceMode) job() bool {
+	return d.ReplicatedJob != nil || d.GlobalJob != nil
+}
+
+func (d dockerServiceMode) name() string {
+	switch {
+	case d.Global != nil:
+		return serviceModeGlobal
+	case d.ReplicatedJob != nil:
+		return serviceModeReplicatedJob
+	case d.GlobalJob != nil:
+		return serviceModeGlobalJob
+	default:
+		return serviceModeReplicated
+	}
+}
+
+type dockerServiceTaskTemplate struct {
+	ContainerSpec dockerServiceContainerSpec `json:"ContainerSpec"`
+}
+
+type dockerServiceContainerSpec struct {
+	Image  string            `json:"Image"`
+	Env    []string          `json:"Env"`
+	Labels map[string]string `json:"Labels"`
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/os/osutil"
+)
+
+// writes Prometheus file_sd_configs compatible files, for setups where Prometheus (or vmagent,
+// Grafana Agent etc.) cannot reach us over HTTPS but we have a shared volume.
+// https://prometheus.io/docs/guides/file-sd/
+type fileSdConfig struct {
+	path     string // file to write to, or a directory if perJob
+	perJob   bool   // one file per job, named "promswarmconnect-<job>.json"
+	interval time.Duration
+}
+
+func fileSdConfigFromEnv() (*fileSdConfig, error) {
+	path := os.Getenv("FILE_SD_PATH")
+	if path == "" { // file_sd mode not enabled
+		return nil, nil
+	}
+
+	interval := 30 * time.Second
+	if intervalSerialized := os.Getenv("FILE_SD_INTERVAL"); intervalSerialized != "" {
+		var err error
+		interval, err = time.ParseDuration(intervalSerialized)
+		if err != nil {
+			return nil, fmt.Errorf("FILE_SD_INTERVAL: %w", err)
+		}
+	}
+
+	return &fileSdConfig{
+		path:     path,
+		perJob:   os.Getenv("FILE_SD_PER_JOB") == "true",
+		interval: interval,
+	}, nil
+}
+
+func fileSdWriter(
+	ctx context.Context,
+	conf fileSdConfig,
+	discover discoverFn,
+	logger *log.Logger,
+) error {
+	logl := logex.Levels(logger)
+
+	writer := &fileSdFiles{
+		previousContent: map[string][]byte{},
+	}
+
+	refreshOnce := func() {
+		snapshot, err := discover(ctx)
+		if err != nil {
+			// keep serving the previously written files. the next round will hopefully succeed
+			logl.Error.Printf("discover: %v", err)
+			return
+		}
+
+		if err := writer.write(conf, serviceInstancesToHttpSdResponse(snapshot.services, snapshot.jobNameStrategy)); err != nil {
+			logl.Error.Printf("write: %v", err)
+		}
+	}
+
+	refreshOnce()
+
+	refresh := time.NewTicker(conf.interval)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-refresh.C:
+			refreshOnce()
+		}
+	}
+}
+
+// keeps track of files we've written, so we can skip identical writes (Prometheus watches
+// the files and re-reads on each change) and remove files of jobs that went away
+type fileSdFiles struct {
+	previousContent map[string][]byte // keyed by filename
+}
+
+func (f *fileSdFiles) write(conf fileSdConfig, targetGroups []HttpSdTargetGroup) error {
+	files := map[string][]HttpSdTargetGroup{}
+
+	if conf.perJob {
+		for _, targetGroup := range targetGroups {
+			filename := filepath.Join(conf.path, fileSdFilenameForJob(targetGroup.Labels["job"]))
+
+			files[filename] = append(files[filename], targetGroup)
+		}
+	} else {
+		files[conf.path] = targetGroups
+	}
+
+	filenames := []string{}
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames) // for deterministic error reporting
+
+	for _, filename := range filenames {
+		content, err := json.MarshalIndent(files[filename], "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if previous, written := f.previousContent[filename]; written && bytes.Equal(previous, content) {
+			continue
+		}
+
+		if err := osutil.WriteFileAtomic(filename, func(sink io.Writer) error {
+			_, err := sink.Write(content)
+			return err
+		}); err != nil {
+			return err
+		}
+
+		f.previousContent[filename] = content
+	}
+
+	// remove files for jobs that no longer exist. we look at the directory instead of only
+	// what we've written, so files from our previous runs (e.g. renamed jobs) go away too.
+	// the directory can be shared with other SD files, so only touch files named like ours.
+	if conf.perJob {
+		existing, err := filepath.Glob(filepath.Join(conf.path, fileSdFilenamePrefix+"*.json"))
+		if err != nil {
+			return err
+		}
+
+		for _, filename := range existing {
+			if _, stillExists := files[filename]; stillExists {
+				continue
+			}
+
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	for filename := range f.previousContent {
+		if _, stillExists := files[filename]; !stillExists {
+			delete(f.previousContent, filename)
+		}
+	}
+
+	return nil
+}
+
+var unsafeFilenameCharsRe = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// marks per-job files as ours
+const fileSdFilenamePrefix = "promswarmconnect-"
+
+// "hellohttp" => "promswarmconnect-hellohttp.json"
+// "foo/bar" => "promswarmconnect-foo_bar.json"
+func fileSdFilenameForJob(job string) string {
+	return fileSdFilenamePrefix + unsafeFilenameCharsRe.ReplaceAllString(job, "_") + ".json"
+}
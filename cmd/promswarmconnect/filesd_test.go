@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestFileSdWritePerJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promswarmconnect-filesd-")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := fileSdConfig{path: dir, perJob: true}
+
+	// left over from a previous run, where the job had a different name
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(dir, "promswarmconnect-oldname.json"), []byte("[]"), 0644))
+	// not ours (shared SD directory)
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(dir, "handwritten.json"), []byte("[]"), 0644))
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0644))
+
+	files := &fileSdFiles{previousContent: map[string][]byte{}}
+
+	assert.Ok(t, files.write(conf, serviceInstancesToHttpSdResponse([]Service{serviceDef(map[string]string{
+		"METRICS_ENDPOINT":  "/metrics,job=foo",
+		"METRICS_ENDPOINT2": "/metrics,job=bar/baz",
+	}, inst1)}, "")))
+
+	assert.EqualString(t, readDirNames(t, dir), "README handwritten.json promswarmconnect-bar_baz.json promswarmconnect-foo.json")
+
+	foo, err := ioutil.ReadFile(filepath.Join(dir, "promswarmconnect-foo.json"))
+	assert.Ok(t, err)
+	assert.EqualString(t, string(foo), `[
+  {
+    "targets": [
+      "10.0.0.2:80"
+    ],
+    "labels": {
+      "__metrics_path__": "/metrics",
+      "__scheme__": "http",
+      "instance": "task1",
+      "job": "foo"
+    }
+  }
+]`)
+
+	// job "bar/baz" went away => its file should be removed
+	assert.Ok(t, files.write(conf, serviceInstancesToHttpSdResponse([]Service{serviceDef(map[string]string{
+		"METRICS_ENDPOINT": "/metrics,job=foo",
+	}, inst1)}, "")))
+
+	assert.EqualString(t, readDirNames(t, dir), "README handwritten.json promswarmconnect-foo.json")
+}
+
+func TestFileSdFilenameForJob(t *testing.T) {
+	assert.EqualString(t, fileSdFilenameForJob("hellohttp"), "promswarmconnect-hellohttp.json")
+	assert.EqualString(t, fileSdFilenameForJob("foo/bar baz"), "promswarmconnect-foo_bar_baz.json")
+}
+
+func readDirNames(t *testing.T, dir string) string {
+	t.Helper()
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.Ok(t, err)
+
+	names := ""
+	for _, entry := range entries {
+		if names != "" {
+			names += " "
+		}
+		names += entry.Name()
+	}
+
+	return names
+}
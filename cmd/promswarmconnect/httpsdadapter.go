@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+)
+
+// https://prometheus.io/docs/prometheus/latest/http_sd/
+type HttpSdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+func metricsEndpointsToHttpSdResponse(endpoints []MetricsEndpoint) []HttpSdTargetGroup {
+	targetGroups := []HttpSdTargetGroup{}
+
+	for _, endpoint := range endpoints {
+		// unlike with Triton, we can use Prometheus' real label names, so no relabeling
+		// hacks are needed on Prometheus' side. __address__ is populated from "targets".
+		labels := map[string]string{}
+
+		// service's own labels first, so they can't override ours
+		for key, value := range endpoint.Labels {
+			labels[key] = value
+		}
+
+		labels["__metrics_path__"] = endpoint.MetricsPath
+		labels["__scheme__"] = endpoint.Scheme
+		labels["job"] = endpoint.Job
+		labels["instance"] = endpoint.Instance
+
+		// __meta_* labels are available for relabeling, but are not added to the series
+		if endpoint.ServiceMode != "" {
+			labels["__meta_swarm_service_mode"] = endpoint.ServiceMode
+		}
+
+		if endpoint.TaskSlot != 0 {
+			labels["__meta_swarm_task_slot"] = strconv.Itoa(endpoint.TaskSlot)
+		}
+
+		for name, value := range endpoint.Params {
+			labels["__param_"+name] = value
+		}
+
+		if endpoint.ScrapeInterval != "" {
+			labels["__scrape_interval__"] = endpoint.ScrapeInterval
+		}
+
+		if endpoint.ScrapeTimeout != "" {
+			labels["__scrape_timeout__"] = endpoint.ScrapeTimeout
+		}
+
+		if endpoint.Cluster != "" {
+			labels["cluster"] = endpoint.Cluster
+		}
+
+		targetGroups = append(targetGroups, HttpSdTargetGroup{
+			Targets: []string{endpoint.Address},
+			Labels:  labels,
+		})
+	}
+
+	return targetGroups
+}
+
+func serviceInstancesToHttpSdResponse(services []Service, defaultJobStrategy jobNameStrategy) []HttpSdTargetGroup {
+	return metricsEndpointsToHttpSdResponse(serviceToMetricsEndpoints(services, defaultJobStrategy))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestHttpSdExtraLabels(t *testing.T) {
+	assert.EqualJson(t, serviceInstancesToHttpSdResponse([]Service{serviceDef(map[string]string{
+		"METRICS_ENDPOINT": "/metrics?module=default,label.team=payments,label.tier=backend,interval=2m,timeout=30s",
+	}, inst1)}, ""), `[
+  {
+    "targets": [
+      "10.0.0.2:80"
+    ],
+    "labels": {
+      "__metrics_path__": "/metrics",
+      "__param_module": "default",
+      "__scheme__": "http",
+      "__scrape_interval__": "2m",
+      "__scrape_timeout__": "30s",
+      "instance": "task1",
+      "job": "hellohttp",
+      "team": "payments",
+      "tier": "backend"
+    }
+  }
+]`)
+}
+
+func TestHttpSdMetaLabels(t *testing.T) {
+	slotted := inst1
+	slotted.Slot = 2
+
+	service := serviceDef(map[string]string{
+		"METRICS_ENDPOINT": "/metrics",
+	}, slotted)
+	service.Mode = serviceModeReplicated
+
+	assert.EqualJson(t, serviceInstancesToHttpSdResponse([]Service{service}, "")[0].Labels, `{
+  "__meta_swarm_service_mode": "replicated",
+  "__meta_swarm_task_slot": "2",
+  "__metrics_path__": "/metrics",
+  "__scheme__": "http",
+  "instance": "task1",
+  "job": "hellohttp"
+}`)
+}
+
+func TestServiceInstancesToHttpSdResponse(t *testing.T) {
+	noProperEnvVarResult := serviceInstancesToHttpSdResponse([]Service{serviceDef(map[string]string{
+		"foo": "bar",
+	}, inst1)}, "")
+	assert.Assert(t, len(noProperEnvVarResult) == 0)
+
+	assert.EqualJson(t, serviceInstancesToHttpSdResponse([]Service{serviceDef(map[string]string{
+		"METRICS_ENDPOINT": ":443/metrics,instance=_HOSTNAME_",
+	}, inst1, inst2)}, ""), `[
+  {
+    "targets": [
+      "10.0.0.2:443"
+    ],
+    "labels": {
+      "__metrics_path__": "/metrics",
+      "__scheme__": "https",
+      "instance": "node1.example.com",
+      "job": "hellohttp"
+    }
+  },
+  {
+    "targets": [
+      "10.0.0.3:443"
+    ],
+    "labels": {
+      "__metrics_path__": "/metrics",
+      "__scheme__": "https",
+      "instance": "node1.example.com",
+      "job": "hellohttp"
+    }
+  }
+]`)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// how the default job label is derived from a service. Swarm stack services are named
+// "<stack>_<service>", so with the default the job label changes if the stack is redeployed
+// under a different name
+type jobNameStrategy string
+
+const (
+	jobNameStrategyService             jobNameStrategy = "service"               // "hello_hellohttp"
+	jobNameStrategyServiceWithoutStack jobNameStrategy = "service_without_stack" // "hellohttp"
+	jobNameStrategyStackAndService     jobNameStrategy = "stack_and_service"     // "hello/hellohttp"
+	jobNameStrategyImage               jobNameStrategy = "image"                 // "joonas/hellohttp"
+)
+
+var jobNameStrategies = []jobNameStrategy{
+	jobNameStrategyService,
+	jobNameStrategyServiceWithoutStack,
+	jobNameStrategyStackAndService,
+	jobNameStrategyImage,
+}
+
+func parseJobNameStrategy(serialized string) (jobNameStrategy, error) {
+	for _, strategy := range jobNameStrategies {
+		if string(strategy) == serialized {
+			return strategy, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown job name strategy: %s", serialized)
+}
+
+// per-service override (ENV or label) of the global JOB_NAME_STRATEGY ("" = default default)
+func jobNameStrategyForService(service Service, defaultStrategy jobNameStrategy) (jobNameStrategy, error) {
+	key := "METRICS_JOB_NAME_STRATEGY"
+	serialized, found := service.ENVs[key]
+	if !found {
+		key = "promswarmconnect.job_name_strategy"
+		serialized, found = service.Labels[key]
+	}
+
+	if !found {
+		if defaultStrategy == "" {
+			return jobNameStrategyService, nil
+		}
+
+		return defaultStrategy, nil
+	}
+
+	strategy, err := parseJobNameStrategy(serialized)
+	if err != nil { // reported like a bad endpoint specifier
+		return "", &endpointSpecifierError{key, serialized, err}
+	}
+
+	return strategy, nil
+}
+
+func defaultJobName(service Service, strategy jobNameStrategy) string {
+	serviceWithoutStack := strings.TrimPrefix(service.Name, service.Stack+"_")
+
+	switch strategy {
+	case jobNameStrategyServiceWithoutStack:
+		return serviceWithoutStack
+	case jobNameStrategyStackAndService:
+		if service.Stack == "" {
+			return service.Name
+		}
+
+		return service.Stack + "/" + serviceWithoutStack
+	case jobNameStrategyImage:
+		if repository := imageRepository(service.Image); repository != "" {
+			return repository
+		}
+
+		return service.Name
+	default:
+		return service.Name
+	}
+}
+
+// "registry.example.com:5000/joonas/hellohttp:latest@sha256:..." => "joonas/hellohttp".
+// "" for image IDs ("sha256:...")
+func imageRepository(image string) string {
+	if strings.HasPrefix(image, "sha256:") {
+		return ""
+	}
+
+	if digestPos := strings.Index(image, "@"); digestPos != -1 {
+		image = image[0:digestPos]
+	}
+
+	// colon after last slash is the tag (others can be a registry's port)
+	if tagPos := strings.LastIndex(image, ":"); tagPos > strings.LastIndex(image, "/") {
+		image = image[0:tagPos]
+	}
+
+	// Docker's rule: first component is a registry if it looks like a hostname
+	if components := strings.SplitN(image, "/", 2); len(components) == 2 {
+		if strings.ContainsAny(components[0], ".:") || components[0] == "localhost" {
+			image = components[1]
+		}
+	}
+
+	return image
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestJobNameStrategies(t *testing.T) {
+	stackService := Service{
+		Name:  "hello_hellohttp",
+		Image: "registry.example.com:5000/joonas/hellohttp:latest@sha256:abcd",
+		Stack: "hello",
+	}
+
+	jobName := func(t *testing.T, service Service, strategy jobNameStrategy) string {
+		t.Helper()
+
+		service.ENVs = map[string]string{"METRICS_ENDPOINT": "/metrics"}
+		service.Instances = []ServiceInstance{inst1}
+
+		endpoints, rejected := serviceToMetricsEndpointsAndRejections([]Service{service}, strategy)
+		if len(rejected) > 0 {
+			return rejected[0].Error
+		}
+
+		return endpoints[0].Job
+	}
+
+	assert.EqualString(t, jobName(t, stackService, ""), "hello_hellohttp")
+	assert.EqualString(t, jobName(t, stackService, jobNameStrategyService), "hello_hellohttp")
+	assert.EqualString(t, jobName(t, stackService, jobNameStrategyServiceWithoutStack), "hellohttp")
+	assert.EqualString(t, jobName(t, stackService, jobNameStrategyStackAndService), "hello/hellohttp")
+	assert.EqualString(t, jobName(t, stackService, jobNameStrategyImage), "joonas/hellohttp")
+
+	nonStackService := Service{Name: "hellohttp", Image: "sha256:abcd"}
+
+	assert.EqualString(t, jobName(t, nonStackService, jobNameStrategyStackAndService), "hellohttp")
+	assert.EqualString(t, jobName(t, nonStackService, jobNameStrategyImage), "hellohttp")
+
+	// per-service override
+	overridden := stackService
+	overridden.Labels = map[string]string{"promswarmconnect.job_name_strategy": "service_without_stack"}
+
+	assert.EqualString(t, jobName(t, overridden, jobNameStrategyImage), "hellohttp")
+
+	overridden.Labels = map[string]string{"promswarmconnect.job_name_strategy": "foo"}
+
+	assert.EqualString(t, jobName(t, overridden, jobNameStrategyImage), "unknown job name strategy: foo")
+}
+
+func TestInvalidJobNameStrategyRejectedOnce(t *testing.T) {
+	service := serviceDef(map[string]string{
+		"METRICS_ENDPOINT":          "/metrics",
+		"METRICS_ENDPOINT2":         "/metrics2",
+		"METRICS_JOB_NAME_STRATEGY": "foo",
+	}, inst1)
+
+	endpoints, rejected := serviceToMetricsEndpointsAndRejections([]Service{service}, "")
+	assert.Assert(t, len(endpoints) == 0)
+	assert.EqualJson(t, rejected, `[
+  {
+    "service": "hellohttp",
+    "key": "METRICS_JOB_NAME_STRATEGY",
+    "value": "foo",
+    "error": "unknown job name strategy: foo"
+  }
+]`)
+}
+
+func TestImageRepository(t *testing.T) {
+	assert.EqualString(t, imageRepository("hellohttp"), "hellohttp")
+	assert.EqualString(t, imageRepository("joonas/hellohttp:latest"), "joonas/hellohttp")
+	assert.EqualString(t, imageRepository("localhost/hellohttp"), "hellohttp")
+	assert.EqualString(t, imageRepository("localhost:5000/joonas/hellohttp:1.0"), "joonas/hellohttp")
+	assert.EqualString(t, imageRepository("joonas/hellohttp@sha256:abcd"), "joonas/hellohttp")
+	assert.EqualString(t, imageRepository("sha256:abcd"), "")
+}
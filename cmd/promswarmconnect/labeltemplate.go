@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// data available for job= and instance= templates, e.g. "{{.Node.Hostname}}-{{.Task.Slot}}"
+type labelTemplateData struct {
+	Service string
+	Stack   string
+	Cluster string
+	Node    struct {
+		ID       string
+		Hostname string
+	}
+	Task struct {
+		ID   string
+		Slot int // 0 if not a replicated service
+	}
+	Container struct {
+		ID      string
+		ShortID string // as in "$ docker ps"
+	}
+}
+
+func newLabelTemplateData(service Service, instance ServiceInstance) labelTemplateData {
+	data := labelTemplateData{
+		Service: service.Name,
+		Stack:   service.Stack,
+		Cluster: service.Cluster,
+	}
+
+	data.Node.ID = instance.NodeID
+	data.Node.Hostname = instance.NodeHostname
+	data.Task.ID = instance.DockerTaskId
+	data.Task.Slot = instance.Slot
+	data.Container.ID = instance.ContainerID
+	data.Container.ShortID = instance.ContainerID
+	if len(data.Container.ShortID) > 12 {
+		data.Container.ShortID = data.Container.ShortID[0:12]
+	}
+
+	return data
+}
+
+type labelTemplate struct {
+	tpl *template.Template
+}
+
+// parsed templates by their source, since endpoints are computed for each discovery request
+// but the specifiers rarely change
+var labelTemplateCache = struct {
+	templates map[string]labelTemplateCacheEntry
+	mu        sync.Mutex
+}{
+	templates: map[string]labelTemplateCacheEntry{},
+}
+
+type labelTemplateCacheEntry struct {
+	tpl *labelTemplate
+	err error
+}
+
+// the cache is only a guard against specifiers that keep changing (e.g. redeploys with new
+// values) eating our memory
+const labelTemplateCacheMaxSize = 1000
+
+// exact "_HOSTNAME_" is supported as alias for "{{.Node.Hostname}}" for backwards compatibility
+func parseLabelTemplate(serialized string) (*labelTemplate, error) {
+	labelTemplateCache.mu.Lock()
+	defer labelTemplateCache.mu.Unlock()
+
+	if cached, found := labelTemplateCache.templates[serialized]; found {
+		return cached.tpl, cached.err
+	}
+
+	tpl, err := parseLabelTemplateUncached(serialized)
+
+	if len(labelTemplateCache.templates) >= labelTemplateCacheMaxSize {
+		labelTemplateCache.templates = map[string]labelTemplateCacheEntry{}
+	}
+
+	labelTemplateCache.templates[serialized] = labelTemplateCacheEntry{tpl, err}
+
+	return tpl, err
+}
+
+func parseLabelTemplateUncached(serialized string) (*labelTemplate, error) {
+	if serialized == "_HOSTNAME_" {
+		serialized = "{{.Node.Hostname}}"
+	}
+
+	tpl, err := template.New("label").Option("missingkey=error").Parse(serialized)
+	if err != nil {
+		return nil, err
+	}
+
+	// referencing non-existing fields is only noticed when executing
+	if err := tpl.Execute(&strings.Builder{}, labelTemplateData{}); err != nil {
+		return nil, err
+	}
+
+	return &labelTemplate{tpl}, nil
+}
+
+func (l *labelTemplate) render(data labelTemplateData) (string, error) {
+	output := &strings.Builder{}
+	if err := l.tpl.Execute(output, data); err != nil {
+		return "", err
+	}
+
+	if output.Len() == 0 {
+		return "", errors.New("template produced empty label value")
+	}
+
+	return output.String(), nil
+}
@@ -4,23 +4,32 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/function61/gokit/app/dynversion"
 	"github.com/function61/gokit/app/udocker"
 	"github.com/function61/gokit/log/logex"
 	"github.com/function61/gokit/net/http/httputils"
 	"github.com/function61/gokit/os/osutil"
+	"github.com/function61/gokit/sync/taskrunner"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Service struct {
 	Name      string
 	Image     string
+	Stack     string // Swarm stack (or docker-compose project) the service belongs to, if any
+	Cluster   string // name of the Docker endpoint the service was discovered from. "" if only one
+	Mode      string // Swarm service mode ("replicated", "global", ...). "" for standalone containers
 	ENVs      map[string]string
+	Labels    map[string]string
 	Instances []ServiceInstance
 }
 
@@ -28,49 +37,240 @@ type ServiceInstance struct {
 	DockerTaskId string
 	NodeID       string
 	NodeHostname string
-	IPv4         string
+	Networks     []ServiceInstanceNetwork // our scrape networks the instance is on, in priority order
+	Slot         int                      // replicated services' tasks are numbered 1..replicas. 0 otherwise
+	ContainerID  string                   // "" if task's container is not known yet
 }
 
-func registerTritonDiscoveryApi(mux *http.ServeMux) error {
-	networkName, err := osutil.GetenvRequired("NETWORK_NAME")
+type ServiceInstanceNetwork struct {
+	Name string   // "host" (for Swarm) or "bridge" (for standalone containers) for fallbacks
+	IPs  []string // preferred address family (ADDRESS_FAMILY) first
+}
+
+// network by name, or by default the highest priority one. nil if instance is not on it
+func (s ServiceInstance) network(name string) *ServiceInstanceNetwork {
+	for _, network := range s.Networks {
+		if name == "" || network.Name == name {
+			return &network
+		}
+	}
+
+	return nil
+}
+
+// produces current state of services from a discovery backend
+type discoverFn func(ctx context.Context) (*discoverySnapshot, error)
+
+type discoverySnapshot struct {
+	services    []Service
+	rejected    []RejectedEndpointSpecifier
+	skipped     skipCounts
+	statuses    []DiscoveryStatus // one per Docker endpoint
+	refreshedAt time.Time         // when services were last known to be up-to-date
+	refreshErr  error             // non-nil if services are last-known-good because refreshing failed
+
+	jobNameStrategy jobNameStrategy // default for services, from discovery config
+}
+
+// one discovery per Docker endpoint. endpoints are configured with the same suffix convention
+// as METRICS_ENDPOINT: DOCKER_URL, DOCKER_URL2, DOCKER_URL3, ... each endpoint's settings
+// (NETWORK_NAME2, DOCKER_CLIENTCERT2, ...) fall back to the unsuffixed ones.
+func dockerDiscoveriesFromEnv(logger *log.Logger) ([]*dockerDiscoveryCache, error) {
+	if _, err := osutil.GetenvRequired("DOCKER_URL"); err != nil {
+		return nil, err
+	}
+
+	suffixes := []string{""}
+	for i := 2; os.Getenv(fmt.Sprintf("DOCKER_URL%d", i)) != ""; i++ {
+		suffixes = append(suffixes, fmt.Sprintf("%d", i))
+	}
+
+	discoveries := []*dockerDiscoveryCache{}
+	clusterNames := map[string]bool{}
+
+	for _, suff := range suffixes {
+		clusterName := os.Getenv("CLUSTER_NAME" + suff)
+		if len(suffixes) > 1 { // otherwise we can't tell the clusters' targets apart
+			if clusterName == "" {
+				return nil, fmt.Errorf("CLUSTER_NAME%s required when using multiple Docker endpoints", suff)
+			}
+
+			if clusterNames[clusterName] {
+				return nil, fmt.Errorf("CLUSTER_NAME%s: duplicate name: %s", suff, clusterName)
+			}
+			clusterNames[clusterName] = true
+		}
+
+		discoveryLogger := logger
+		if clusterName != "" {
+			discoveryLogger = logex.Prefix(clusterName, logger)
+		}
+
+		discovery, err := dockerDiscoveryFromEnv(suff, clusterName, discoveryLogger)
+		if err != nil {
+			return nil, err
+		}
+
+		discoveries = append(discoveries, discovery)
+	}
+
+	return discoveries, nil
+}
+
+func dockerDiscoveryFromEnv(suff string, clusterName string, logger *log.Logger) (*dockerDiscoveryCache, error) {
+	// can be a list, in priority order
+	networkNamesKey := endpointEnvKey("NETWORK_NAME", suff)
+	networkNames, err := parseNetworkNames(os.Getenv(networkNamesKey))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%s: %w", networkNamesKey, err)
 	}
 
-	dockerUrl, err := osutil.GetenvRequired("DOCKER_URL")
+	ownContainerId := ""
+	if len(networkNames) == 0 {
+		ownContainerId = selfContainerId()
+
+		logex.Levels(logger).Info.Printf(
+			"NETWORK_NAME not set; using networks of own container %s",
+			ownContainerId)
+	}
+
+	taskStatesSerialized := os.Getenv("TASK_STATES")
+	if taskStatesSerialized == "" {
+		taskStatesSerialized = taskStateRunning
+	}
+
+	taskStates, err := parseTaskStatePolicy(taskStatesSerialized)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("TASK_STATES: %w", err)
+	}
+
+	addressFamily := addressFamilyIPv4
+	if addressFamilySerialized := os.Getenv("ADDRESS_FAMILY"); addressFamilySerialized != "" {
+		addressFamily, err = parseAddressFamily(addressFamilySerialized)
+		if err != nil {
+			return nil, fmt.Errorf("ADDRESS_FAMILY: %w", err)
+		}
+	}
+
+	jobNameStrategy := jobNameStrategyService
+	if jobNameStrategySerialized := os.Getenv("JOB_NAME_STRATEGY"); jobNameStrategySerialized != "" {
+		jobNameStrategy, err = parseJobNameStrategy(jobNameStrategySerialized)
+		if err != nil {
+			return nil, fmt.Errorf("JOB_NAME_STRATEGY: %w", err)
+		}
+	}
+
+	dockerUrl, err := osutil.GetenvRequired("DOCKER_URL" + suff)
+	if err != nil {
+		return nil, err
 	}
 
 	dockerClient, dockerUrlTransformed, err := udocker.Client(
 		dockerUrl,
-		clientCertFromEnvOrFile,
+		clientCertFromEnvOrFile(suff),
 		true)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	resyncInterval := 1 * time.Minute
+	if resyncIntervalSerialized := os.Getenv("DOCKER_RESYNC_INTERVAL"); resyncIntervalSerialized != "" {
+		resyncInterval, err = time.ParseDuration(resyncIntervalSerialized)
+		if err != nil {
+			return nil, fmt.Errorf("DOCKER_RESYNC_INTERVAL: %w", err)
+		}
+	}
+
+	maxStaleness := 5 * time.Minute
+	if maxStalenessSerialized := os.Getenv("MAX_STALENESS"); maxStalenessSerialized != "" {
+		maxStaleness, err = time.ParseDuration(maxStalenessSerialized)
+		if err != nil {
+			return nil, fmt.Errorf("MAX_STALENESS: %w", err)
+		}
 	}
 
 	// for unix sockets we need to fake "http://localhost"
 	dockerUrl = dockerUrlTransformed
 
+	return newDockerDiscoveryCache(
+		dockerUrl,
+		dockerDiscoveryConfig{
+			networkNames:    networkNames,
+			selfContainerId: ownContainerId,
+			taskStates:      taskStates,
+			clusterName:     clusterName,
+			jobNameStrategy: jobNameStrategy,
+			addressFamily:   addressFamily,
+		},
+		dockerClient,
+		resyncInterval,
+		maxStaleness,
+		logger), nil
+}
+
+func registerTritonDiscoveryApi(mux *http.ServeMux, discover discoverFn) {
 	// adapts Docker Swarm services to Prometheus by pretending to be Triton discovery service.
 	// requires also some hacking via Prometheus config, because we're passing data in fields
 	// in different format than Prometheus expects
-	mux.HandleFunc("/v1/discover", func(w http.ResponseWriter, r *http.Request) {
-		services, err := listDockerServiceAndContainerInstances(
-			r.Context(),
-			dockerUrl,
-			networkName,
-			dockerClient)
+	mux.HandleFunc("/v1/discover", discoveryHandler(discover, func(endpoints []MetricsEndpoint) interface{} {
+		return metricsEndpointToTritonResponse(endpoints)
+	}))
+
+	// same data as above, but in Prometheus' native HTTP SD format which needs no relabeling
+	mux.HandleFunc("/v1/http_sd", discoveryHandler(discover, func(endpoints []MetricsEndpoint) interface{} {
+		return metricsEndpointsToHttpSdResponse(endpoints)
+	}))
+
+	// so service owners can find out why their service is not being scraped
+	mux.HandleFunc("/v1/rejected", func(w http.ResponseWriter, r *http.Request) {
+		snapshot, err := discover(r.Context())
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		jsonResponse(w, serviceInstancesToTritonContainers(services))
+		jsonResponse(w, snapshot.rejected)
 	})
 
-	return nil
+	// which discovery sources are active (e.g. not a Swarm manager => only containers)
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		snapshot, err := discover(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, snapshot.statuses)
+	})
+}
+
+func discoveryHandler(
+	discover discoverFn,
+	endpointsToResponse func([]MetricsEndpoint) interface{},
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshot, err := discover(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// lets operators see if we're serving last-known-good data
+		w.Header().Set("X-Discovery-Age", fmt.Sprintf("%.0f", time.Since(snapshot.refreshedAt).Seconds()))
+		if snapshot.refreshErr != nil {
+			w.Header().Set("X-Discovery-Stale", "true")
+		}
+
+		// Prometheus' Triton SD sends its configured groups as "?groups=foo,bar"
+		groups := []string{}
+		if groupsSerialized := r.URL.Query().Get("groups"); groupsSerialized != "" {
+			groups = strings.Split(groupsSerialized, ",")
+		}
+
+		jsonResponse(w, endpointsToResponse(filterMetricsEndpointsByGroups(
+			serviceToMetricsEndpoints(snapshot.services, snapshot.jobNameStrategy),
+			groups)))
+	}
 }
 
 func main() {
@@ -84,50 +284,105 @@ func main() {
 func mainInternal(ctx context.Context, logger *log.Logger) error {
 	logl := logex.Levels(logger)
 
-	mux := http.NewServeMux()
+	dockerDiscoveries, err := dockerDiscoveriesFromEnv(logex.Prefix("dockerdiscovery", logger))
+	if err != nil {
+		return err
+	}
 
-	if err := registerTritonDiscoveryApi(mux); err != nil {
+	discover := mergeDiscoveries(dockerDiscoveries)
+
+	fileSdConf, err := fileSdConfigFromEnv()
+	if err != nil {
 		return err
 	}
 
-	serverCert, err := tls.X509KeyPair([]byte(dummyCert), []byte(dummyCertKey))
+	mux := http.NewServeMux()
+
+	registerTritonDiscoveryApi(mux, discover)
+
+	prometheus.MustRegister(
+		newDiscoveryCollector(discover),
+		dockerRequestDuration,
+		dockerRequestErrors,
+		buildInfo)
+
+	mux.Handle("/metrics", promhttp.Handler())
+
+	serverCert, err := serverCertificateFromEnv(logex.Prefix("servercert", logger))
 	if err != nil {
 		return err
 	}
 
-	// we need TLS even though calling Prometheus specifies InsecureSkipVerify, because
-	// the code in Prometheus is hardcoded to use https. well, I guess encryption without
-	// authentication is still better than no encryption at all.
+	// we need TLS even if calling Prometheus specifies InsecureSkipVerify (i.e. when using
+	// our self-signed cert), because the code in Prometheus is hardcoded to use https. well,
+	// I guess encryption without authentication is still better than no encryption at all.
 	srv := &http.Server{
 		Handler: mux,
 		Addr:    ":443",
 		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{serverCert},
+			GetCertificate: serverCert.GetCertificate,
 		},
 	}
 
+	if err := configureClientAuthFromEnv(srv.TLSConfig); err != nil {
+		return err
+	}
+
 	logl.Info.Printf("Started v%s", dynversion.Version)
 
-	return httputils.CancelableServer(ctx, srv, func() error { return srv.ListenAndServeTLS("", "") })
-}
+	tasks := taskrunner.New(ctx, logger)
 
-func clientCertFromEnvOrFile() (*tls.Certificate, error) {
-	clientCert, err := getDataFromEnvBase64OrFile("DOCKER_CLIENTCERT")
-	if err != nil {
-		return nil, err
+	for _, dockerDiscovery := range dockerDiscoveries {
+		taskName := "dockerdiscovery"
+		if dockerDiscovery.conf.clusterName != "" {
+			taskName += " " + dockerDiscovery.conf.clusterName
+		}
+
+		tasks.Start(taskName, dockerDiscovery.Run)
 	}
 
-	clientCertKey, err := getDataFromEnvBase64OrFile("DOCKER_CLIENTCERT_KEY")
-	if err != nil {
-		return nil, err
+	tasks.Start("listener "+srv.Addr, func(ctx context.Context) error {
+		return httputils.CancelableServer(ctx, srv, func() error { return srv.ListenAndServeTLS("", "") })
+	})
+
+	if fileSdConf != nil {
+		tasks.Start("filesd", func(ctx context.Context) error {
+			return fileSdWriter(ctx, *fileSdConf, discover, logex.Prefix("filesd", logger))
+		})
 	}
 
-	clientKeypair, err := tls.X509KeyPair(clientCert, clientCertKey)
-	if err != nil {
-		return nil, err
+	return tasks.Wait()
+}
+
+// client cert for Docker endpoint identified by suffix
+func clientCertFromEnvOrFile(suff string) func() (*tls.Certificate, error) {
+	return func() (*tls.Certificate, error) {
+		clientCert, err := getDataFromEnvBase64OrFile(endpointEnvKey("DOCKER_CLIENTCERT", suff))
+		if err != nil {
+			return nil, err
+		}
+
+		clientCertKey, err := getDataFromEnvBase64OrFile(endpointEnvKey("DOCKER_CLIENTCERT_KEY", suff))
+		if err != nil {
+			return nil, err
+		}
+
+		clientKeypair, err := tls.X509KeyPair(clientCert, clientCertKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return &clientKeypair, nil
+	}
+}
+
+// ("NETWORK_NAME", "2") => "NETWORK_NAME2" if it's set, otherwise "NETWORK_NAME"
+func endpointEnvKey(key string, suff string) string {
+	if os.Getenv(key+suff) != "" {
+		return key + suff
 	}
 
-	return &clientKeypair, nil
+	return key
 }
 
 // read ENV var (identified by key) value as base64, or if value begins with "@/home/foo/data.txt",
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/function61/gokit/app/dynversion"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// promswarmconnect's own metrics (i.e. not about the discovered targets)
+
+var (
+	dockerRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "promswarmconnect_docker_request_duration_seconds",
+		Help: "Duration of Docker API requests",
+	}, []string{"endpoint"})
+
+	dockerRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "promswarmconnect_docker_request_errors_total",
+		Help: "Failed Docker API requests",
+	}, []string{"endpoint"})
+
+	buildInfo = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "promswarmconnect_build_info",
+		Help:        "Always 1. Version is in the label",
+		ConstLabels: prometheus.Labels{"version": dynversion.Version},
+	}, func() float64 { return 1 })
+)
+
+// metrics derived from the current discovery snapshot, computed at scrape time
+type discoveryCollector struct {
+	discover                   discoverFn
+	up                         *prometheus.Desc
+	services                   *prometheus.Desc
+	tasks                      *prometheus.Desc
+	targets                    *prometheus.Desc
+	skipped                    *prometheus.Desc
+	rejectedEndpointSpecifiers *prometheus.Desc
+	age                        *prometheus.Desc
+	stale                      *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*discoveryCollector)(nil)
+
+func newDiscoveryCollector(discover discoverFn) *discoveryCollector {
+	return &discoveryCollector{
+		discover: discover,
+		up: prometheus.NewDesc(
+			"promswarmconnect_discovery_up",
+			"1 if discovery has data to serve (possibly stale), 0 if discovery requests fail",
+			nil,
+			nil),
+		services: prometheus.NewDesc(
+			"promswarmconnect_discovered_services",
+			"Services (and standalone containers) discovered",
+			nil,
+			nil),
+		tasks: prometheus.NewDesc(
+			"promswarmconnect_discovered_tasks",
+			"Tasks (and standalone containers) discovered that have an address we can scrape",
+			nil,
+			nil),
+		targets: prometheus.NewDesc(
+			"promswarmconnect_discovered_targets",
+			"Scrape targets served to Prometheus",
+			nil,
+			nil),
+		skipped: prometheus.NewDesc(
+			"promswarmconnect_skipped",
+			"Tasks, containers with an endpoint specifier (no_network_attachment, no_ip) or endpoint specifiers (bad_specifier) skipped",
+			[]string{"reason"},
+			nil),
+		rejectedEndpointSpecifiers: prometheus.NewDesc(
+			"promswarmconnect_rejected_endpoint_specifiers",
+			"Endpoint specifiers that failed to parse, per service and key (see /v1/rejected for details)",
+			[]string{"cluster", "service", "key"},
+			nil),
+		age: prometheus.NewDesc(
+			"promswarmconnect_discovery_age_seconds",
+			"Seconds since discovered services were last known to be up-to-date",
+			nil,
+			nil),
+		stale: prometheus.NewDesc(
+			"promswarmconnect_discovery_stale",
+			"1 if refreshing from Docker is failing and we're serving last-known-good services",
+			nil,
+			nil),
+	}
+}
+
+func (d *discoveryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.up
+	ch <- d.services
+	ch <- d.tasks
+	ch <- d.targets
+	ch <- d.skipped
+	ch <- d.rejectedEndpointSpecifiers
+	ch <- d.age
+	ch <- d.stale
+}
+
+func (d *discoveryCollector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(desc *prometheus.Desc, value float64, labelValues ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelValues...)
+	}
+
+	snapshot, err := d.discover(context.Background())
+	if err != nil {
+		gauge(d.up, 0)
+		return
+	}
+
+	gauge(d.up, 1)
+
+	tasks := 0
+	for _, service := range snapshot.services {
+		tasks += len(service.Instances)
+	}
+
+	gauge(d.services, float64(len(snapshot.services)))
+	gauge(d.tasks, float64(tasks))
+	gauge(d.targets, float64(len(serviceToMetricsEndpoints(snapshot.services, snapshot.jobNameStrategy))))
+
+	gauge(d.skipped, float64(snapshot.skipped[skipReasonNoNetworkAttachment]), skipReasonNoNetworkAttachment)
+	gauge(d.skipped, float64(snapshot.skipped[skipReasonNoIp]), skipReasonNoIp)
+	gauge(d.skipped, float64(len(snapshot.rejected)), "bad_specifier")
+
+	// same labels can be rejected many times (e.g. compose replicas share a service name), and
+	// duplicate series would fail the whole scrape
+	type rejectionKey struct {
+		cluster string
+		service string
+		key     string
+	}
+
+	rejectedCounts := map[rejectionKey]int{}
+	for _, rejection := range snapshot.rejected {
+		rejectedCounts[rejectionKey{rejection.Cluster, rejection.Service, rejection.Key}]++
+	}
+
+	for key, count := range rejectedCounts {
+		gauge(d.rejectedEndpointSpecifiers, float64(count), key.cluster, key.service, key.key)
+	}
+
+	gauge(d.age, time.Since(snapshot.refreshedAt).Seconds())
+
+	if snapshot.refreshErr != nil {
+		gauge(d.stale, 1)
+	} else {
+		gauge(d.stale, 0)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDuplicateRejectionsAreSummed(t *testing.T) {
+	rejection := RejectedEndpointSpecifier{
+		Service: "hellohttp",
+		Key:     "METRICS_ENDPOINT",
+		Value:   "metrics",
+		Error:   "bad",
+	}
+
+	collector := newDiscoveryCollector(func(ctx context.Context) (*discoverySnapshot, error) {
+		return &discoverySnapshot{
+			rejected:    []RejectedEndpointSpecifier{rejection, rejection}, // e.g. compose replicas
+			skipped:     skipCounts{},
+			refreshedAt: time.Now(),
+		}, nil
+	})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	families, err := registry.Gather()
+	assert.Ok(t, err)
+
+	for _, family := range families {
+		if family.GetName() != "promswarmconnect_rejected_endpoint_specifiers" {
+			continue
+		}
+
+		assert.Assert(t, len(family.GetMetric()) == 1)
+		assert.Assert(t, family.GetMetric()[0].GetGauge().GetValue() == 2)
+		return
+	}
+
+	t.Fatal("rejected_endpoint_specifiers not found")
+}
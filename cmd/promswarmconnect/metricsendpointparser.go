@@ -3,8 +3,12 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"regexp"
 	"strings"
+
+	"github.com/prometheus/common/model"
 )
 
 type MetricsEndpoint struct {
@@ -14,50 +18,126 @@ type MetricsEndpoint struct {
 	Address     string // __address__
 	MetricsPath string // __metrics_path__
 	Scheme      string // __scheme__
+	Groups      []string
+	Cluster     string            // see Service.Cluster
+	Labels      map[string]string // extra target labels. not supported by Triton output
+
+	// __scrape_interval__ and __scrape_timeout__ (in Prometheus' duration format). "" = use
+	// the scrape config's. not supported by Triton output
+	ScrapeInterval string
+	ScrapeTimeout  string
+
+	// URL query parameters, as __param_<name> labels. not supported by Triton output
+	Params map[string]string
+
+	// available for relabeling as __meta_* labels. not supported by Triton output
+	ServiceMode string
+	TaskSlot    int
 
 	Service *Service
 }
 
+// endpoint specifier that we couldn't parse. a typo in one service's ENV must not break
+// discovery for the whole cluster, so these are skipped and reported instead.
+type RejectedEndpointSpecifier struct {
+	Cluster string `json:"cluster,omitempty"`
+	Service string `json:"service"`
+	Key     string `json:"key"`   // "METRICS_ENDPOINT2"
+	Value   string `json:"value"` // the raw specifier
+	Error   string `json:"error"`
+}
+
 // parses Prometheus endpoints from Service info provided by a discovery backend
 
-func serviceToMetricsEndpoints(services []Service) []MetricsEndpoint {
+// "defaultJobStrategy" is from JOB_NAME_STRATEGY ("" = default default)
+func serviceToMetricsEndpoints(services []Service, defaultJobStrategy jobNameStrategy) []MetricsEndpoint {
+	metricsEndpoints, _ := serviceToMetricsEndpointsAndRejections(services, defaultJobStrategy)
+	return metricsEndpoints
+}
+
+func serviceToMetricsEndpointsAndRejections(
+	services []Service,
+	defaultJobStrategy jobNameStrategy,
+) ([]MetricsEndpoint, []RejectedEndpointSpecifier) {
 	metricsEndpoints := []MetricsEndpoint{}
+	rejected := []RejectedEndpointSpecifier{}
+
+	reject := func(service Service, err error) {
+		specErr := &endpointSpecifierError{err: err}
+		errors.As(err, &specErr)
+
+		rejected = append(rejected, RejectedEndpointSpecifier{
+			Cluster: service.Cluster,
+			Service: service.Name,
+			Key:     specErr.key,
+			Value:   specErr.value,
+			Error:   specErr.err.Error(),
+		})
+	}
 
 	for _, service := range services {
+		if !declaresEndpointSpecifier(service) {
+			continue
+		}
+
+		// shared by all of the service's endpoints, so bad one rejects all of them (but only once)
+		jobStrategy, err := jobNameStrategyForService(service, defaultJobStrategy)
+		if err != nil {
+			reject(service, err)
+			continue
+		}
+
+		processOne := func(suff string) {
+			foundEndpoints, errs := processSuffix(service, suff, jobStrategy)
+
+			for _, err := range errs {
+				reject(service, err)
+			}
+
+			metricsEndpoints = append(metricsEndpoints, foundEndpoints...)
+		}
+
 		// looks up METRICS_ENDPOINT, METRICS_OVERRIDE_INSTANCE
-		foundEndpoints := processSuffix(service, "")
-		metricsEndpoints = append(metricsEndpoints, foundEndpoints...)
-
-		i := 2
-		for {
-			// looks up METRICS_ENDPOINT2, METRICS_OVERRIDE_INSTANCE2 etc.
-			foundEndpoints = processSuffix(service, fmt.Sprintf("%d", i))
-			if len(foundEndpoints) == 0 {
+		processOne("")
+
+		// looks up METRICS_ENDPOINT2, METRICS_OVERRIDE_INSTANCE2 etc.
+		for i := 2; ; i++ {
+			suff := fmt.Sprintf("%d", i)
+
+			if _, _, exists := lookupEndpointSpecifier(service, suff); !exists {
 				break
 			}
 
-			metricsEndpoints = append(metricsEndpoints, foundEndpoints...)
-			i++
+			processOne(suff)
 		}
 	}
 
-	return metricsEndpoints
+	return metricsEndpoints, rejected
 }
 
-func processSuffix(service Service, suff string) []MetricsEndpoint {
+// errors are either for the whole specifier (=> no endpoints), or for individual instances that
+// had to be skipped (=> endpoints for the rest)
+func processSuffix(service Service, suff string, jobStrategy jobNameStrategy) ([]MetricsEndpoint, []error) {
 	// don't add all services, but only those whitelisted by this explicit setting
-	endpointSpecifierRaw, endpointSpecifierExists := service.ENVs["METRICS_ENDPOINT"+suff]
-	if !endpointSpecifierExists {
-		return nil
-	}
-
-	spec, err := parseEndpointSpecifier(endpointSpecifierRaw)
+	spec, err := endpointSpecifierForSuffix(service, suff)
 	if err != nil {
-		panic(err) // FIXME: handle error gracefully
+		return nil, []error{err}
+	}
+	if spec == nil {
+		return nil, nil
 	}
-	metricsEndpointPort := "80"
-	if spec.port != "" {
-		metricsEndpointPort = spec.port
+
+	// template errors are attributed to the specifier the template came from
+	specKey, specValue, _ := lookupEndpointSpecifier(service, suff)
+
+	// default port follows explicitly given scheme
+	metricsEndpointPort := spec.port
+	if metricsEndpointPort == "" {
+		if spec.scheme == "https" {
+			metricsEndpointPort = "443"
+		} else {
+			metricsEndpointPort = "80"
+		}
 	}
 
 	/*	Prometheus timeseries have two required labels for each timeseries:
@@ -78,38 +158,105 @@ func processSuffix(service Service, suff string) []MetricsEndpoint {
 			- use static string (e.g. "n/a") as "instance" label
 	*/
 
-	// this is used to implement cases 2) and 3). use "_HOSTNAME_" to replace with hostname
-	// or any other string to have a static string
+	// this is used to implement cases 2) and 3). use a template like "{{.Node.Hostname}}"
+	// (or its older alias "_HOSTNAME_") or any other string to have a static string
 	// TODO: deprecate this over the now-smarter endpoint specifier
 	overrideInstanceLabel := service.ENVs["METRICS_OVERRIDE_INSTANCE"+suff] // ok if not set
+	overrideInstanceKey, overrideInstanceValue := "METRICS_OVERRIDE_INSTANCE"+suff, overrideInstanceLabel
 	if spec.instanceOverride != "" {
 		overrideInstanceLabel = spec.instanceOverride
+		overrideInstanceKey, overrideInstanceValue = specKey, specValue
+	}
+
+	instanceErr := func(err error) error {
+		return &endpointSpecifierError{overrideInstanceKey, overrideInstanceValue, fmt.Errorf("instance: %w", err)}
+	}
+
+	var instanceTemplate *labelTemplate
+	if overrideInstanceLabel != "" {
+		var err error
+		instanceTemplate, err = parseLabelTemplate(overrideInstanceLabel)
+		if err != nil {
+			return nil, []error{instanceErr(err)}
+		}
+	}
+
+	defaultJob := defaultJobName(service, jobStrategy)
+
+	jobErr := func(err error) error {
+		return &endpointSpecifierError{specKey, specValue, fmt.Errorf("job: %w", err)}
 	}
 
-	jobLabel := service.Name
+	var jobTemplate *labelTemplate
 	if spec.jobOverride != "" {
-		jobLabel = spec.jobOverride
+		var err error
+		jobTemplate, err = parseLabelTemplate(spec.jobOverride)
+		if err != nil {
+			return nil, []error{jobErr(err)}
+		}
+	}
+
+	// for Prometheus' Triton SD "groups" filtering. explicitly given groups, or by default
+	// the stack the service belongs to
+	groups := spec.groups
+	if len(groups) == 0 && service.Stack != "" {
+		groups = []string{service.Stack}
 	}
 
 	metricsEndpoints := []MetricsEndpoint{}
+	instanceErrs := []error{}
 
 	scheme := func() string {
-		if metricsEndpointPort == "443" { // FIXME: support non-default ports also..
+		if spec.scheme != "" {
+			return spec.scheme
+		}
+
+		// guess, if not explicitly given
+		if metricsEndpointPort == "443" {
 			return "https"
 		} else {
 			return "http"
 		}
 	}()
 
+	onNetwork := 0
+
 	for _, instance := range service.Instances {
-		hostAndPort := instance.IPv4 + ":" + metricsEndpointPort
+		network := instance.network(spec.network)
+		if network == nil { // not attached to the network the endpoint asked for
+			continue
+		}
+
+		onNetwork++
+
+		// IPv6 needs brackets
+		hostAndPort := net.JoinHostPort(network.IPs[0], metricsEndpointPort)
+
+		templateData := newLabelTemplateData(service, instance)
 
 		instanceLabel := instance.DockerTaskId
-		if overrideInstanceLabel != "" {
-			instanceLabel = overrideInstanceLabel
+		if service.Mode == serviceModeGlobal || service.Mode == serviceModeGlobalJob {
+			// one task per node, so node is more meaningful (think node_exporter or cAdvisor)
+			instanceLabel = instance.NodeHostname
+		}
 
-			if instanceLabel == "_HOSTNAME_" {
-				instanceLabel = instance.NodeHostname
+		// rendering can fail for only some instances (e.g. empty value), so skip just them
+		if instanceTemplate != nil {
+			var err error
+			instanceLabel, err = instanceTemplate.render(templateData)
+			if err != nil {
+				instanceErrs = append(instanceErrs, instanceErr(fmt.Errorf("task %s: %w", instance.DockerTaskId, err)))
+				continue
+			}
+		}
+
+		jobLabel := defaultJob
+		if jobTemplate != nil {
+			var err error
+			jobLabel, err = jobTemplate.render(templateData)
+			if err != nil {
+				instanceErrs = append(instanceErrs, jobErr(fmt.Errorf("task %s: %w", instance.DockerTaskId, err)))
+				continue
 			}
 		}
 
@@ -119,39 +266,179 @@ func processSuffix(service Service, suff string) []MetricsEndpoint {
 			Address:     hostAndPort,
 			MetricsPath: spec.path,
 			Scheme:      scheme,
+			Groups:      groups,
+			Cluster:     service.Cluster,
+			Labels:      spec.labels,
+
+			ScrapeInterval: spec.scrapeInterval,
+			ScrapeTimeout:  spec.scrapeTimeout,
+
+			Params: spec.params,
+
+			ServiceMode: service.Mode,
+			TaskSlot:    instance.Slot,
 
 			Service: &service,
 		})
 	}
 
-	return metricsEndpoints
+	// most likely a typo, or the network is not one we scrape (NETWORK_NAME)
+	if spec.network != "" && len(service.Instances) > 0 && onNetwork == 0 {
+		return nil, []error{&endpointSpecifierError{specKey, specValue, fmt.Errorf("network: no tasks on network %s that we scrape", spec.network)}}
+	}
+
+	return metricsEndpoints, instanceErrs
+}
+
+// endpoint specifier that failed to parse, along with where we read it from
+type endpointSpecifierError struct {
+	key   string
+	value string
+	err   error
+}
+
+func (e *endpointSpecifierError) Error() string {
+	return e.err.Error()
+}
+
+// looks up endpoint specifier (identified by suffix: "", "2", "3", ...) from these, in order
+// of precedence:
+//
+// 1) ENV "METRICS_ENDPOINT"
+// 2) label "promswarmconnect.endpoint". for Swarm services service-level labels take precedence
+//    over container labels. labels are useful if your app validates its ENV.
+// 3) (only for first endpoint) labels "prometheus.io/scrape=true" etc., see
+//    endpointSpecifierFromPrometheusLabels()
+//
+// each suffix is looked up separately, so you can e.g. have METRICS_ENDPOINT as ENV and
+// promswarmconnect.endpoint2 as label.
+//
+// nil specifier (without error) if service doesn't specify one for the suffix
+func endpointSpecifierForSuffix(service Service, suff string) (*endpointSpecifier, error) {
+	if key, value, found := lookupEndpointSpecifier(service, suff); found {
+		spec, err := parseEndpointSpecifier(value)
+		if err != nil {
+			return nil, &endpointSpecifierError{key, value, err}
+		}
+
+		return spec, nil
+	}
+
+	// there's no numbering in the Kubernetes convention, so it can only give one endpoint
+	if suff == "" && service.Labels[prometheusScrapeLabelKey] == "true" {
+		return endpointSpecifierFromPrometheusLabels(service.Labels)
+	}
+
+	return nil, nil
+}
+
+// looks up 1) and 2) of endpointSpecifierForSuffix(). returns the key the specifier was
+// found from
+func lookupEndpointSpecifier(service Service, suff string) (string, string, bool) {
+	if value, found := service.ENVs["METRICS_ENDPOINT"+suff]; found {
+		return "METRICS_ENDPOINT" + suff, value, true
+	}
+
+	if value, found := service.Labels["promswarmconnect.endpoint"+suff]; found {
+		return "promswarmconnect.endpoint" + suff, value, true
+	}
+
+	return "", "", false
+}
+
+// whether the service asks to be scraped at all (even if its specifier then fails to parse).
+// see serviceToMetricsEndpointsAndRejections() for how suffixes are looked up
+func declaresEndpointSpecifier(service Service) bool {
+	for _, suff := range []string{"", "2"} {
+		if _, _, found := lookupEndpointSpecifier(service, suff); found {
+			return true
+		}
+	}
+
+	return service.Labels[prometheusScrapeLabelKey] == "true"
 }
 
 type endpointSpecifier struct {
 	port             string
 	path             string
+	scheme           string // "" = guess from port
 	instanceOverride string
 	jobOverride      string
+	groups           []string
+	labels           map[string]string
+	scrapeInterval   string
+	scrapeTimeout    string
+	params           map[string]string
+	network          string // "" = highest priority network the instance is on
 }
 
-// ":443/metrics" => ("443", "/metrics")
-// "/metrics" => ("", "/metrics")
-var splitPortAndPathRe = regexp.MustCompile("^(:([0-9]+))?(.+)")
+// Prometheus can only pass one value per parameter with __param_<name> labels, and the
+// parameter name has to be usable in a label name (so e.g. "collect[]" is not)
+func (e *endpointSpecifier) addParam(name string, value string) error {
+	if !labelNameRe.MatchString("__param_" + name) {
+		return fmt.Errorf("parameter %s: name not supported by Prometheus", name)
+	}
+
+	if _, exists := e.params[name]; exists {
+		return fmt.Errorf("parameter %s: multiple values not supported", name)
+	}
+
+	e.params[name] = value
+
+	return nil
+}
+
+// ":443/metrics" => ("443", "/metrics", "")
+// "/metrics" => ("", "/metrics", "")
+// "/probe?module=http_2xx" => ("", "/probe", "module=http_2xx")
+var splitPortAndPathRe = regexp.MustCompile(`^(:([0-9]+))?([^?]+)(\?(.*))?$`)
+
+// "https://:8443/metrics" => ("https", ":8443/metrics")
+// ":8443/metrics" => ("", ":8443/metrics")
+var splitSchemeRe = regexp.MustCompile("^(https?)://(.*)")
 
 // parses values like:
 //     "/metrics"
 //     ":80/metrics,job=hellohttp,instance=fas5324df"
+//     "/metrics,group=infra,group=slow"
+//     "https://:8443/metrics" (or ":8443/metrics,scheme=https")
+//     "/metrics,label.team=payments,label.tier=backend"
+//     "/metrics,interval=2m,timeout=30s"
+//     "/probe?module=http_2xx" (or "/probe,param.module=http_2xx")
+//     "/metrics,network=monitoring-staging"
 func parseEndpointSpecifier(hostPort string) (*endpointSpecifier, error) {
 	portions := strings.Split(hostPort, ",")
 
+	scheme := ""
+	if schemeParse := splitSchemeRe.FindStringSubmatch(portions[0]); schemeParse != nil {
+		scheme = schemeParse[1]
+		portions[0] = schemeParse[2]
+	}
+
 	hostPortParse := splitPortAndPathRe.FindStringSubmatch(portions[0])
 	if hostPortParse == nil {
 		return nil, errors.New("unable to parse host:port")
 	}
 
 	spec := endpointSpecifier{
-		port: hostPortParse[2],
-		path: hostPortParse[3],
+		port:   hostPortParse[2],
+		path:   hostPortParse[3],
+		scheme: scheme,
+		labels: map[string]string{},
+		params: map[string]string{},
+	}
+
+	query, err := url.ParseQuery(hostPortParse[5])
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+
+	for name, values := range query {
+		for _, value := range values {
+			if err := spec.addParam(name, value); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	for _, portion := range portions[1:] {
@@ -163,19 +450,159 @@ func parseEndpointSpecifier(hostPort string) (*endpointSpecifier, error) {
 		key := portion[0:equalsPos]
 		value := portion[equalsPos+1:]
 
+		// unknown key is reported even if its value is also empty
+		if !knownEndpointSpecifierKey(key) {
+			return nil, fmt.Errorf("unknown key: %s", key)
+		}
+
+		if value == "" {
+			return nil, fmt.Errorf("empty value for key: %s", key)
+		}
+
+		if strings.HasPrefix(key, "label.") {
+			labelName := key[len("label."):]
+
+			if err := validateTargetLabelName(labelName); err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+
+			spec.labels[labelName] = value
+			continue
+		}
+
+		if strings.HasPrefix(key, "param.") {
+			if err := spec.addParam(key[len("param."):], value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		switch key {
 		case "job":
 			spec.jobOverride = value
 		case "instance":
 			spec.instanceOverride = value
-		default:
-			return nil, fmt.Errorf("unknown key: %s", key)
+		case "group": // can be given multiple times
+			spec.groups = append(spec.groups, value)
+		case "scheme":
+			if !validScheme(value) {
+				return nil, errors.New("scheme must be http or https")
+			}
+
+			if spec.scheme != "" && spec.scheme != value {
+				return nil, errors.New("scheme conflicts with URL's scheme")
+			}
+
+			spec.scheme = value
+		case "network":
+			spec.network = value
+		case "interval":
+			if _, err := model.ParseDuration(value); err != nil {
+				return nil, fmt.Errorf("interval: %w", err)
+			}
+
+			spec.scrapeInterval = value
+		case "timeout":
+			if _, err := model.ParseDuration(value); err != nil {
+				return nil, fmt.Errorf("timeout: %w", err)
+			}
+
+			spec.scrapeTimeout = value
 		}
+	}
 
-		if value == "" {
-			return nil, fmt.Errorf("empty value for key: %s", key)
+	// Prometheus would refuse the target
+	if spec.scrapeInterval != "" && spec.scrapeTimeout != "" {
+		interval, _ := model.ParseDuration(spec.scrapeInterval)
+		timeout, _ := model.ParseDuration(spec.scrapeTimeout)
+
+		if timeout > interval {
+			return nil, errors.New("timeout greater than interval")
 		}
 	}
 
 	return &spec, nil
 }
+
+var endpointSpecifierKeys = []string{"job", "instance", "group", "scheme", "network", "interval", "timeout"}
+
+func knownEndpointSpecifierKey(key string) bool {
+	return strings.HasPrefix(key, "label.") || strings.HasPrefix(key, "param.") || stringSliceContains(endpointSpecifierKeys, key)
+}
+
+// Kubernetes-style annotations, which many third-party images and people are already used to
+const (
+	prometheusScrapeLabelKey = "prometheus.io/scrape"
+	prometheusPortLabelKey   = "prometheus.io/port"
+	prometheusPathLabelKey   = "prometheus.io/path"
+	prometheusSchemeLabelKey = "prometheus.io/scheme"
+)
+
+var portRe = regexp.MustCompile("^[0-9]+$")
+
+// for services labeled "prometheus.io/scrape=true". port defaults to 80 and path to /metrics
+func endpointSpecifierFromPrometheusLabels(labels map[string]string) (*endpointSpecifier, error) {
+	spec := endpointSpecifier{
+		port:   labels[prometheusPortLabelKey],
+		path:   labels[prometheusPathLabelKey],
+		scheme: labels[prometheusSchemeLabelKey],
+	}
+
+	if spec.port != "" && !portRe.MatchString(spec.port) {
+		return nil, &endpointSpecifierError{prometheusPortLabelKey, spec.port, errors.New("invalid port")}
+	}
+
+	if spec.path == "" {
+		spec.path = "/metrics"
+	} else if !strings.HasPrefix(spec.path, "/") {
+		return nil, &endpointSpecifierError{prometheusPathLabelKey, spec.path, errors.New("path must start with /")}
+	}
+
+	if spec.scheme != "" && !validScheme(spec.scheme) {
+		return nil, &endpointSpecifierError{prometheusSchemeLabelKey, spec.scheme, errors.New("scheme must be http or https")}
+	}
+
+	return &spec, nil
+}
+
+// https://prometheus.io/docs/concepts/data_model/#metric-names-and-labels
+var labelNameRe = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+func validateTargetLabelName(name string) error {
+	switch {
+	case !labelNameRe.MatchString(name):
+		return errors.New("invalid label name")
+	case strings.HasPrefix(name, "__"): // reserved for Prometheus' internal use
+		return errors.New("label names starting with __ are reserved")
+	case name == "job" || name == "instance":
+		return errors.New("use job= or instance= instead")
+	case name == "cluster": // set from the Docker endpoint's CLUSTER_NAME
+		return errors.New("reserved for the Docker endpoint's cluster name")
+	default:
+		return nil
+	}
+}
+
+func validScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// "groups" are from Prometheus' Triton SD config. no groups => no filtering
+func filterMetricsEndpointsByGroups(endpoints []MetricsEndpoint, groups []string) []MetricsEndpoint {
+	if len(groups) == 0 {
+		return endpoints
+	}
+
+	filtered := []MetricsEndpoint{}
+
+	for _, endpoint := range endpoints {
+		for _, group := range groups {
+			if stringSliceContains(endpoint.Groups, group) {
+				filtered = append(filtered, endpoint)
+				break
+			}
+		}
+	}
+
+	return filtered
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/function61/gokit/testing/assert"
@@ -12,7 +13,7 @@ func TestServiceToMetricsEndpointsNo(t *testing.T) {
 		"foo": "bar", // no METRICS_ENDPOINT defined => will not parse as endpoint
 	}
 
-	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(metricsEndpointMissing, inst1, inst2)})
+	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(metricsEndpointMissing, inst1, inst2)}, "")
 	assert.Assert(t, len(endpoints) == 0)
 }
 
@@ -21,7 +22,7 @@ func TestServiceToMetricsEndpoints(t *testing.T) {
 		"METRICS_ENDPOINT": ":80/metrics",
 	}
 
-	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(envs, inst1, inst2)})
+	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(envs, inst1, inst2)}, "")
 	assert.Assert(t, len(endpoints) == 2)
 
 	assertEndpoint(t, endpoints[0], "job<hellohttp> instance<task1> address<10.0.0.2:80> path</metrics>")
@@ -33,7 +34,7 @@ func TestServiceToMetricsEndpointsDifferentPortAndPath(t *testing.T) {
 		"METRICS_ENDPOINT": ":443/foometrics",
 	}
 
-	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(envs, inst1, inst2)})
+	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(envs, inst1, inst2)}, "")
 	assert.Assert(t, len(endpoints) == 2)
 
 	assertEndpoint(t, endpoints[0], "job<hellohttp> instance<task1> address<10.0.0.2:443> path</foometrics>")
@@ -46,7 +47,7 @@ func TestServiceToMetricsEndpointsOverrideInstance(t *testing.T) {
 		"METRICS_OVERRIDE_INSTANCE": "n/a",
 	}
 
-	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(envs, inst1, inst2)})
+	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(envs, inst1, inst2)}, "")
 	assert.Assert(t, len(endpoints) == 2)
 
 	assertEndpoint(t, endpoints[0], "job<hellohttp> instance<n/a> address<10.0.0.2:80> path</metrics>")
@@ -59,7 +60,7 @@ func TestServiceToMetricsEndpointsOverrideInstanceWithHostname(t *testing.T) {
 		"METRICS_OVERRIDE_INSTANCE": "_HOSTNAME_", // can be used for host-level metrics
 	}
 
-	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(envs, inst1)})
+	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(envs, inst1)}, "")
 	assert.Assert(t, len(endpoints) == 1)
 
 	assertEndpoint(t, endpoints[0], "job<hellohttp> instance<node1.example.com> address<10.0.0.2:80> path</metrics>")
@@ -71,19 +72,104 @@ func TestServiceToMetricsEndpointsOverrideInstanceWithHostnameV2(t *testing.T) {
 		"METRICS_ENDPOINT": "/metrics,instance=_HOSTNAME_",
 	}
 
-	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(envs, inst1)})
+	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(envs, inst1)}, "")
 	assert.Assert(t, len(endpoints) == 1)
 
 	assertEndpoint(t, endpoints[0], "job<hellohttp> instance<node1.example.com> address<10.0.0.2:80> path</metrics>")
 }
 
+func TestServiceToMetricsEndpointsGlobalServiceInstanceDefaultsToHostname(t *testing.T) {
+	global := serviceDef(map[string]string{
+		"METRICS_ENDPOINT":  "/metrics",
+		"METRICS_ENDPOINT2": "/metrics,instance={{.Task.ID}}", // explicit wins
+	}, inst1)
+	global.Mode = serviceModeGlobal
+
+	endpoints := serviceToMetricsEndpoints([]Service{global}, "")
+	assert.Assert(t, len(endpoints) == 2)
+
+	assertEndpoint(t, endpoints[0], "job<hellohttp> instance<node1.example.com> address<10.0.0.2:80> path</metrics>")
+	assertEndpoint(t, endpoints[1], "job<hellohttp> instance<task1> address<10.0.0.2:80> path</metrics>")
+}
+
+func TestServiceToMetricsEndpointsTemplates(t *testing.T) {
+	slotted := inst1
+	slotted.Slot = 3
+	slotted.ContainerID = "0123456789abcdef0123"
+
+	jobAndInstance := func(t *testing.T, specifier string) string {
+		t.Helper()
+
+		service := serviceDef(map[string]string{
+			"METRICS_ENDPOINT": specifier,
+		}, slotted)
+		service.Stack = "hello"
+
+		endpoints, rejected := serviceToMetricsEndpointsAndRejections([]Service{service}, "")
+		if len(rejected) > 0 {
+			return rejected[0].Error
+		}
+
+		return endpoints[0].Job + " " + endpoints[0].Instance
+	}
+
+	assert.EqualString(t, jobAndInstance(t, "/metrics,instance={{.Node.Hostname}}-{{.Task.Slot}}"), "hellohttp node1.example.com-3")
+	assert.EqualString(t, jobAndInstance(t, "/metrics,job={{.Stack}}/{{.Service}},instance={{.Node.ID}}"), "hello/hellohttp node1")
+	assert.EqualString(t, jobAndInstance(t, "/metrics,instance={{.Container.ShortID}}"), "hellohttp 0123456789ab")
+	assert.EqualString(t, jobAndInstance(t, "/metrics,instance=_HOSTNAME_"), "hellohttp node1.example.com")
+	// alias only applies to the whole value
+	assert.EqualString(t, jobAndInstance(t, "/metrics,instance=my_HOSTNAME_"), "hellohttp my_HOSTNAME_")
+
+	assert.EqualString(t, jobAndInstance(t, "/metrics,instance={{.Foo}}"), `instance: template: label:1:2: executing "label" at <.Foo>: can't evaluate field Foo in type main.labelTemplateData`)
+	assert.EqualString(t, jobAndInstance(t, "/metrics,job={{.Stack"), `job: template: label:1: unclosed action`)
+	assert.EqualString(t, jobAndInstance(t, "/metrics,job={{.Cluster}}"), "job: task task1: template produced empty label value")
+}
+
+func TestServiceToMetricsEndpointsTemplateErrors(t *testing.T) {
+	withoutContainer := inst2
+	withContainer := inst1
+	withContainer.ContainerID = "0123456789abcdef0123"
+
+	endpoints, rejected := serviceToMetricsEndpointsAndRejections([]Service{serviceDef(map[string]string{
+		"METRICS_ENDPOINT":           "/metrics,job={{.Foo}}",
+		"METRICS_ENDPOINT2":          "/metrics,instance={{.Container.ShortID}}",
+		"METRICS_ENDPOINT3":          "/metrics",
+		"METRICS_OVERRIDE_INSTANCE3": "{{.Bar}}",
+	}, withContainer, withoutContainer)}, "")
+
+	// failing render only skips that instance
+	assert.Assert(t, len(endpoints) == 1)
+	assertEndpoint(t, endpoints[0], "job<hellohttp> instance<0123456789ab> address<10.0.0.2:80> path</metrics>")
+
+	assert.EqualJson(t, rejected, `[
+  {
+    "service": "hellohttp",
+    "key": "METRICS_ENDPOINT",
+    "value": "/metrics,job={{.Foo}}",
+    "error": "job: template: label:1:2: executing \"label\" at \u003c.Foo\u003e: can't evaluate field Foo in type main.labelTemplateData"
+  },
+  {
+    "service": "hellohttp",
+    "key": "METRICS_ENDPOINT2",
+    "value": "/metrics,instance={{.Container.ShortID}}",
+    "error": "instance: task task2: template produced empty label value"
+  },
+  {
+    "service": "hellohttp",
+    "key": "METRICS_OVERRIDE_INSTANCE3",
+    "value": "{{.Bar}}",
+    "error": "instance: template: label:1:2: executing \"label\" at \u003c.Bar\u003e: can't evaluate field Bar in type main.labelTemplateData"
+  }
+]`)
+}
+
 func TestServiceToMetricsEndpointsMultipleEndpoints(t *testing.T) {
 	envs := map[string]string{
 		"METRICS_ENDPOINT":  "/metrics/foo,job=foo",
 		"METRICS_ENDPOINT2": "/metrics/bar,job=bar",
 	}
 
-	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(envs, inst1, inst2)})
+	endpoints := serviceToMetricsEndpoints([]Service{serviceDef(envs, inst1, inst2)}, "")
 	assert.Assert(t, len(endpoints) == 4)
 
 	assertEndpoint(t, endpoints[0], "job<foo> instance<task1> address<10.0.0.2:80> path</metrics/foo>")
@@ -92,6 +178,172 @@ func TestServiceToMetricsEndpointsMultipleEndpoints(t *testing.T) {
 	assertEndpoint(t, endpoints[3], "job<bar> instance<task2> address<10.0.0.3:80> path</metrics/bar>")
 }
 
+func TestServiceToMetricsEndpointsScheme(t *testing.T) {
+	scheme := func(specifier string) string {
+		endpoints := serviceToMetricsEndpoints([]Service{serviceDef(map[string]string{
+			"METRICS_ENDPOINT": specifier,
+		}, inst1)}, "")
+		return endpoints[0].Scheme
+	}
+
+	assert.EqualString(t, scheme(":80/metrics"), "http")
+	assert.EqualString(t, scheme(":443/metrics"), "https") // guessed from port
+	assert.EqualString(t, scheme(":8443/metrics,scheme=https"), "https")
+	assert.EqualString(t, scheme("http://:443/metrics"), "http")
+
+	// default port follows explicit scheme
+	endpoint := func(specifier string) MetricsEndpoint {
+		return serviceToMetricsEndpoints([]Service{serviceDef(map[string]string{
+			"METRICS_ENDPOINT": specifier,
+		}, inst1)}, "")[0]
+	}
+
+	assertEndpoint(t, endpoint("https:///metrics"), "job<hellohttp> instance<task1> address<10.0.0.2:443> path</metrics>")
+	assertEndpoint(t, endpoint("/metrics,scheme=https"), "job<hellohttp> instance<task1> address<10.0.0.2:443> path</metrics>")
+	assertEndpoint(t, endpoint("/metrics,scheme=http"), "job<hellohttp> instance<task1> address<10.0.0.2:80> path</metrics>")
+	assertEndpoint(t, endpoint("https://:8443/metrics"), "job<hellohttp> instance<task1> address<10.0.0.2:8443> path</metrics>")
+	assert.EqualString(t, endpoint("/metrics,scheme=https").Scheme, "https")
+
+	labeled := serviceDef(map[string]string{}, inst1)
+	labeled.Labels = map[string]string{
+		"prometheus.io/scrape": "true",
+		"prometheus.io/scheme": "https",
+	}
+
+	labeledEndpoint := serviceToMetricsEndpoints([]Service{labeled}, "")[0]
+	assertEndpoint(t, labeledEndpoint, "job<hellohttp> instance<task1> address<10.0.0.2:443> path</metrics>")
+	assert.EqualString(t, labeledEndpoint.Scheme, "https")
+}
+
+func TestServiceToMetricsEndpointsFromLabels(t *testing.T) {
+	service := serviceDef(map[string]string{
+		"METRICS_ENDPOINT": "/metrics/env",
+	}, inst1)
+	service.Labels = map[string]string{
+		"promswarmconnect.endpoint":  "/metrics/label", // ENV takes precedence
+		"promswarmconnect.endpoint2": ":8080/metrics/label2",
+	}
+
+	endpoints := serviceToMetricsEndpoints([]Service{service}, "")
+	assert.Assert(t, len(endpoints) == 2)
+
+	assertEndpoint(t, endpoints[0], "job<hellohttp> instance<task1> address<10.0.0.2:80> path</metrics/env>")
+	assertEndpoint(t, endpoints[1], "job<hellohttp> instance<task1> address<10.0.0.2:8080> path</metrics/label2>")
+
+	// label-only service, with rejection reported with the label's key
+	labelOnly := serviceDef(map[string]string{}, inst1)
+	labelOnly.Labels = map[string]string{
+		"promswarmconnect.endpoint": "/metrics,foo=bar",
+	}
+
+	_, rejected := serviceToMetricsEndpointsAndRejections([]Service{labelOnly}, "")
+	assert.Assert(t, len(rejected) == 1)
+	assert.EqualString(t, rejected[0].Key, "promswarmconnect.endpoint")
+}
+
+func TestServiceToMetricsEndpointsFromPrometheusLabels(t *testing.T) {
+	withLabels := func(labels map[string]string) Service {
+		service := serviceDef(map[string]string{}, inst1)
+		service.Labels = labels
+		return service
+	}
+
+	endpoints, rejected := serviceToMetricsEndpointsAndRejections([]Service{
+		withLabels(map[string]string{
+			"prometheus.io/scrape": "true", // defaults to :80/metrics
+		}),
+		withLabels(map[string]string{
+			"prometheus.io/scrape": "true",
+			"prometheus.io/port":   "8443",
+			"prometheus.io/path":   "/admin/metrics",
+			"prometheus.io/scheme": "https",
+		}),
+		withLabels(map[string]string{
+			"prometheus.io/scrape": "false",
+			"prometheus.io/port":   "8080",
+		}),
+		withLabels(map[string]string{
+			"prometheus.io/scrape":      "true", // our own specifier takes precedence
+			"promswarmconnect.endpoint": ":9090/metrics",
+		}),
+		withLabels(map[string]string{
+			"prometheus.io/scrape": "true",
+			"prometheus.io/port":   "http",
+		}),
+	}, "")
+
+	assert.Assert(t, len(endpoints) == 3)
+
+	assertEndpoint(t, endpoints[0], "job<hellohttp> instance<task1> address<10.0.0.2:80> path</metrics>")
+	assertEndpoint(t, endpoints[1], "job<hellohttp> instance<task1> address<10.0.0.2:8443> path</admin/metrics>")
+	assert.EqualString(t, endpoints[1].Scheme, "https")
+	assertEndpoint(t, endpoints[2], "job<hellohttp> instance<task1> address<10.0.0.2:9090> path</metrics>")
+
+	assert.EqualJson(t, rejected, `[
+  {
+    "service": "hellohttp",
+    "key": "prometheus.io/port",
+    "value": "http",
+    "error": "invalid port"
+  }
+]`)
+}
+
+func TestServiceToMetricsEndpointsRejectsMalformed(t *testing.T) {
+	typo := serviceDef(map[string]string{
+		"METRICS_ENDPOINT":  "/metrics,jbo=foo",
+		"METRICS_ENDPOINT2": "/metrics/bar,job=bar", // still discovered
+	}, inst1)
+
+	ok := serviceDef(map[string]string{
+		"METRICS_ENDPOINT": "/metrics",
+	}, inst2)
+	ok.Name = "otherservice"
+
+	endpoints, rejected := serviceToMetricsEndpointsAndRejections([]Service{typo, ok}, "")
+	assert.Assert(t, len(endpoints) == 2)
+
+	assertEndpoint(t, endpoints[0], "job<bar> instance<task1> address<10.0.0.2:80> path</metrics/bar>")
+	assertEndpoint(t, endpoints[1], "job<otherservice> instance<task2> address<10.0.0.3:80> path</metrics>")
+
+	assert.EqualJson(t, rejected, `[
+  {
+    "service": "hellohttp",
+    "key": "METRICS_ENDPOINT",
+    "value": "/metrics,jbo=foo",
+    "error": "unknown key: jbo"
+  }
+]`)
+}
+
+func TestFilterMetricsEndpointsByGroups(t *testing.T) {
+	stackService := serviceDef(map[string]string{
+		"METRICS_ENDPOINT":  "/metrics",              // in stack's group by default
+		"METRICS_ENDPOINT2": "/expensive,group=slow", // explicit group overrides stack
+	}, inst1)
+	stackService.Stack = "monitoring"
+
+	multiGroupService := serviceDef(map[string]string{
+		"METRICS_ENDPOINT": "/metrics,job=multi,group=slow,group=infra",
+	}, inst2)
+
+	endpoints := serviceToMetricsEndpoints([]Service{stackService, multiGroupService}, "")
+
+	jobsAndPaths := func(groups ...string) string {
+		out := []string{}
+		for _, endpoint := range filterMetricsEndpointsByGroups(endpoints, groups) {
+			out = append(out, endpoint.Job+endpoint.MetricsPath)
+		}
+		return strings.Join(out, " ")
+	}
+
+	assert.EqualString(t, jobsAndPaths(), "hellohttp/metrics hellohttp/expensive multi/metrics")
+	assert.EqualString(t, jobsAndPaths("monitoring"), "hellohttp/metrics")
+	assert.EqualString(t, jobsAndPaths("slow"), "hellohttp/expensive multi/metrics")
+	assert.EqualString(t, jobsAndPaths("infra", "monitoring"), "hellohttp/metrics multi/metrics")
+	assert.EqualString(t, jobsAndPaths("nonexistent"), "")
+}
+
 func TestParseEndpointSpecifier(t *testing.T) {
 	oneSpecifier := func(t *testing.T, input string, expectedRepr string) {
 		t.Helper()
@@ -102,9 +354,10 @@ func TestParseEndpointSpecifier(t *testing.T) {
 			actualRepr = err.Error()
 		} else {
 			actualRepr = fmt.Sprintf(
-				"path<%s> port<%s> job<%s> instance<%s>",
+				"path<%s> port<%s> scheme<%s> job<%s> instance<%s>",
 				spec.path,
 				spec.port,
+				spec.scheme,
 				spec.jobOverride,
 				spec.instanceOverride)
 		}
@@ -112,15 +365,59 @@ func TestParseEndpointSpecifier(t *testing.T) {
 		assert.EqualString(t, actualRepr, expectedRepr)
 	}
 
-	oneSpecifier(t, ":80/metrics", "path</metrics> port<80> job<> instance<>")
-	oneSpecifier(t, "/metrics,job=overriddenJob", "path</metrics> port<> job<overriddenJob> instance<>")
-	oneSpecifier(t, "/metrics,instance=overriddenInstance", "path</metrics> port<> job<> instance<overriddenInstance>")
-	oneSpecifier(t, "/metrics,job=hello,instance=inst1", "path</metrics> port<> job<hello> instance<inst1>")
+	oneSpecifier(t, ":80/metrics", "path</metrics> port<80> scheme<> job<> instance<>")
+	oneSpecifier(t, "/metrics,job=overriddenJob", "path</metrics> port<> scheme<> job<overriddenJob> instance<>")
+	oneSpecifier(t, "/metrics,instance=overriddenInstance", "path</metrics> port<> scheme<> job<> instance<overriddenInstance>")
+	oneSpecifier(t, "/metrics,job=hello,instance=inst1", "path</metrics> port<> scheme<> job<hello> instance<inst1>")
+
+	// scheme
+	oneSpecifier(t, "https://:8443/metrics", "path</metrics> port<8443> scheme<https> job<> instance<>")
+	oneSpecifier(t, "http://:443/metrics,job=hello", "path</metrics> port<443> scheme<http> job<hello> instance<>")
+	oneSpecifier(t, "https:///metrics", "path</metrics> port<> scheme<https> job<> instance<>")
+	oneSpecifier(t, ":8443/metrics,scheme=https", "path</metrics> port<8443> scheme<https> job<> instance<>")
+	oneSpecifier(t, "https://:8443/metrics,scheme=https", "path</metrics> port<8443> scheme<https> job<> instance<>")
+
+	// query params
+	params := func(t *testing.T, input string, expected string) {
+		t.Helper()
+
+		spec, err := parseEndpointSpecifier(input)
+		assert.Ok(t, err)
+		assert.EqualString(t, spec.path, "/probe")
+		assert.EqualJson(t, spec.params, expected)
+	}
+
+	params(t, "/probe?module=http_2xx&target=example.com", `{
+  "module": "http_2xx",
+  "target": "example.com"
+}`)
+	params(t, "/probe,param.module=http_2xx", `{
+  "module": "http_2xx"
+}`)
+	params(t, "/probe?module=http_2xx,param.target=example.com,job=blackbox", `{
+  "module": "http_2xx",
+  "target": "example.com"
+}`)
 
 	// failures
 	oneSpecifier(t, "", "unable to parse host:port")
+	oneSpecifier(t, "/metrics?collect[]=foo", "parameter collect[]: name not supported by Prometheus")
+	oneSpecifier(t, "/metrics?module=a&module=b", "parameter module: multiple values not supported")
+	oneSpecifier(t, "/metrics?module=a,param.module=b", "parameter module: multiple values not supported")
 	oneSpecifier(t, "/metrics,foo=bar", "unknown key: foo")
 	oneSpecifier(t, "/metrics,job=", "empty value for key: job")
+	oneSpecifier(t, "/metrics,foo=", "unknown key: foo")
+	oneSpecifier(t, "/metrics,scheme=", "empty value for key: scheme")
+	oneSpecifier(t, "/metrics,scheme=ftp", "scheme must be http or https")
+	oneSpecifier(t, "/metrics,label.team-name=x", "label.team-name: invalid label name")
+	oneSpecifier(t, "/metrics,label.__address__=x", "label.__address__: label names starting with __ are reserved")
+	oneSpecifier(t, "/metrics,label.job=x", "label.job: use job= or instance= instead")
+	oneSpecifier(t, "/metrics,label.cluster=x", "label.cluster: reserved for the Docker endpoint's cluster name")
+	oneSpecifier(t, "/metrics,label.team=", "empty value for key: label.team")
+	oneSpecifier(t, "/metrics,interval=2 minutes", `interval: not a valid duration string: "2 minutes"`)
+	oneSpecifier(t, "/metrics,timeout=30", `timeout: not a valid duration string: "30"`)
+	oneSpecifier(t, "/metrics,interval=15s,timeout=1m", "timeout greater than interval")
+	oneSpecifier(t, "https://:8443/metrics,scheme=http", "scheme conflicts with URL's scheme")
 }
 
 func assertEndpoint(t *testing.T, endpoint MetricsEndpoint, expectedRepr string) {
@@ -141,14 +438,14 @@ var inst1 = ServiceInstance{
 	DockerTaskId: "task1",
 	NodeID:       "node1",
 	NodeHostname: "node1.example.com",
-	IPv4:         "10.0.0.2",
+	Networks:     []ServiceInstanceNetwork{{Name: "monitoring", IPs: []string{"10.0.0.2"}}},
 }
 
 var inst2 = ServiceInstance{
 	DockerTaskId: "task2",
 	NodeID:       "node1",
 	NodeHostname: "node1.example.com",
-	IPv4:         "10.0.0.3",
+	Networks:     []ServiceInstanceNetwork{{Name: "monitoring", IPs: []string{"10.0.0.3"}}},
 }
 
 func serviceDef(envs map[string]string, instances ...ServiceInstance) Service {
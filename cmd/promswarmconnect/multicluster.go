@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// merges discoveries of multiple Docker endpoints (think one per Swarm cluster) into one, so
+// one Prometheus discovery endpoint covers all of them. each discovery syncs from its Docker
+// endpoint independently (and thus concurrently), so this only merges their snapshots.
+//
+// one cluster being unavailable must not take down discovery for the others, so we only
+// fail if all of them fail. the merged snapshot is reported stale if any of them is.
+func mergeDiscoveries(discoveries []*dockerDiscoveryCache) discoverFn {
+	if len(discoveries) == 1 { // nothing to merge
+		return discoveries[0].Discover
+	}
+
+	return func(ctx context.Context) (*discoverySnapshot, error) {
+		merged := &discoverySnapshot{
+			services: []Service{},
+			rejected: []RejectedEndpointSpecifier{},
+			skipped:  skipCounts{},
+			statuses: []DiscoveryStatus{},
+
+			jobNameStrategy: discoveries[0].conf.jobNameStrategy, // same for all
+		}
+
+		errs := []string{}
+		succeeded := 0
+
+		for _, discovery := range discoveries {
+			clusterName := discovery.conf.clusterName
+
+			snapshot, err := discovery.Discover(ctx)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", clusterName, err))
+				merged.statuses = append(merged.statuses, DiscoveryStatus{
+					Cluster: clusterName,
+					Sources: []string{},
+					Error:   err.Error(),
+				})
+				continue
+			}
+
+			succeeded++
+
+			merged.services = append(merged.services, snapshot.services...)
+			merged.rejected = append(merged.rejected, snapshot.rejected...)
+			merged.statuses = append(merged.statuses, snapshot.statuses...)
+
+			for reason, count := range snapshot.skipped {
+				merged.skipped[reason] += count
+			}
+
+			// merged data is only as fresh as its oldest part
+			if merged.refreshedAt.IsZero() || snapshot.refreshedAt.Before(merged.refreshedAt) {
+				merged.refreshedAt = snapshot.refreshedAt
+			}
+
+			if snapshot.refreshErr != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", clusterName, snapshot.refreshErr))
+			}
+		}
+
+		if succeeded == 0 {
+			return nil, errors.New(strings.Join(errs, "; "))
+		}
+
+		if len(errs) > 0 {
+			merged.refreshErr = errors.New(strings.Join(errs, "; "))
+		}
+
+		return merged, nil
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestMergeDiscoveries(t *testing.T) {
+	cluster := func(name string, services ...Service) *dockerDiscoveryCache {
+		for idx := range services {
+			services[idx].Cluster = name
+		}
+
+		cache := newDockerDiscoveryCache("", dockerDiscoveryConfig{clusterName: name}, nil, time.Minute, 5*time.Minute, logex.Discard)
+		cache.snapshot = &discoverySnapshot{
+			services:    services,
+			skipped:     skipCounts{skipReasonNoIp: 1},
+			refreshedAt: time.Now(),
+		}
+		return cache
+	}
+
+	prod := cluster("prod", serviceDef(map[string]string{"METRICS_ENDPOINT": "/metrics"}, inst1))
+	staging := cluster("staging", serviceDef(map[string]string{"METRICS_ENDPOINT": "/metrics"}, inst2))
+	tooling := cluster("tooling")
+	tooling.snapshot = nil
+	tooling.refreshErr = errors.New("connection refused")
+
+	discover := mergeDiscoveries([]*dockerDiscoveryCache{prod, staging, tooling})
+
+	snapshot, err := discover(context.Background())
+	assert.Ok(t, err)
+	assert.Assert(t, snapshot.skipped[skipReasonNoIp] == 2)
+	assert.EqualString(t, snapshot.refreshErr.Error(), "tooling: initial sync with Docker not completed yet: connection refused")
+
+	endpoints := serviceToMetricsEndpoints(snapshot.services, "")
+
+	assert.EqualJson(t, metricsEndpointsToHttpSdResponse(endpoints[0:1]), `[
+  {
+    "targets": [
+      "10.0.0.2:80"
+    ],
+    "labels": {
+      "__metrics_path__": "/metrics",
+      "__scheme__": "http",
+      "cluster": "prod",
+      "instance": "task1",
+      "job": "hellohttp"
+    }
+  }
+]`)
+
+	assert.EqualString(t, metricsEndpointToTritonResponse(endpoints).Containers[1].VMUUID, "staging/task2")
+
+	// all failing => error
+	prod.refreshErr = errors.New("manager unavailable")
+	prod.snapshot = nil
+	staging.snapshot = nil
+
+	_, err = mergeDiscoveries([]*dockerDiscoveryCache{prod, staging})(context.Background())
+	assert.Assert(t, err != nil)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// if NETWORK_NAME is not given, we scrape over the networks we ourselves are attached to.
+// that way the networks can't get out of sync with our service's "--network" flags.
+
+// networks that are attached to but can't be used for scraping
+var unscrapeableNetworks = []string{"ingress", "host", "none"}
+
+// cgroup v1: ".../docker/<id>" or ".../docker-<id>.scope"
+// mountinfo (also works with cgroup v2): "/var/lib/docker/containers/<id>/hostname ..."
+var containerIdInProcFileRe = regexp.MustCompile(`(?:docker[-/]|containers/)([0-9a-f]{64})`)
+
+// best-effort. falls back to hostname, which Docker by default sets to the short container ID
+func selfContainerId() string {
+	for _, path := range []string{"/proc/self/cgroup", "/proc/self/mountinfo"} {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		if id := containerIdFromProcFile(content); id != "" {
+			return id
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+func containerIdFromProcFile(content []byte) string {
+	if match := containerIdInProcFileRe.FindSubmatch(content); match != nil {
+		return string(match[1])
+	}
+
+	return ""
+}
+
+// finds our own container from the state, either as a Swarm task or a standalone container
+// (only visible if we're connected to the Docker on our own node). networks are in priority
+// order (the order the service's networks are attached in), so each target is scraped on
+// the first of them it is on
+func selfNetworkNames(state dockerState, selfContainerId string) ([]string, error) {
+	attached, found := selfAttachedNetworkNames(state, selfContainerId)
+	if !found {
+		// fail loudly instead of silently discovering zero targets
+		return nil, fmt.Errorf(
+			"NETWORK_NAME not set and own container (%s) not found to detect networks from. are we connected to the Docker we're running on?",
+			selfContainerId)
+	}
+
+	networkNames := []string{}
+	for _, networkName := range attached {
+		if !stringSliceContains(unscrapeableNetworks, networkName) {
+			networkNames = append(networkNames, networkName)
+		}
+	}
+
+	if len(networkNames) == 0 {
+		return nil, fmt.Errorf(
+			"NETWORK_NAME not set and own container (%s) is not on any network we can scrape over (attached: %s)",
+			selfContainerId,
+			strings.Join(attached, ", "))
+	}
+
+	return networkNames, nil
+}
+
+func selfAttachedNetworkNames(state dockerState, selfContainerId string) ([]string, bool) {
+	isSelf := func(containerId string) bool {
+		// selfContainerId can be a short ID (from hostname)
+		return len(selfContainerId) >= 12 && strings.HasPrefix(containerId, selfContainerId)
+	}
+
+	// tasks first, as the container list doesn't know the order of our networks. it's only
+	// used when the task isn't visible (standalone container, or Docker is not a Swarm manager)
+	for _, task := range state.tasks {
+		if !isSelf(task.Status.ContainerStatus.ContainerID) {
+			continue
+		}
+
+		networkNames := []string{}
+		for _, attachment := range task.NetworksAttachments {
+			networkNames = append(networkNames, attachment.Network.Spec.Name)
+		}
+
+		return networkNames, true
+	}
+
+	for _, container := range state.containers {
+		if !isSelf(container.Id) {
+			continue
+		}
+
+		networkNames := []string{}
+		for networkName := range container.NetworkSettings.Networks {
+			networkNames = append(networkNames, networkName)
+		}
+
+		sort.Strings(networkNames) // map has no order, so at least make it stable
+
+		return networkNames, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/function61/gokit/app/udocker"
+	"github.com/function61/gokit/testing/assert"
+)
+
+const selfContainerIdFull = "3f4d2c1b0a9e8d7c6b5a49382716f5e4d3c2b1a0f9e8d7c6b5a4938271605f4e"
+
+func TestContainerIdFromProcFile(t *testing.T) {
+	for _, tc := range []struct {
+		input  string
+		output string
+	}{
+		{"12:memory:/docker/" + selfContainerIdFull + "\n", selfContainerIdFull},
+		{"1:name=systemd:/system.slice/docker-" + selfContainerIdFull + ".scope\n", selfContainerIdFull},
+		{ // cgroup v2 => mountinfo. overlay layer IDs must not match
+			"1 0 0:1 / / rw - overlay overlay rw,upperdir=/var/lib/docker/overlay2/aa" + strings.Repeat("b", 62) + "/diff\n" +
+				"2 1 0:2 /var/lib/docker/containers/" + selfContainerIdFull + "/hostname /etc/hostname rw\n",
+			selfContainerIdFull,
+		},
+		{"0::/\n", ""},
+	} {
+		tc := tc
+		t.Run(tc.input, func(t *testing.T) {
+			assert.EqualString(t, containerIdFromProcFile([]byte(tc.input)), tc.output)
+		})
+	}
+}
+
+func TestSelfNetworkNamesFromContainer(t *testing.T) {
+	self := containerDef(selfContainerIdFull, nil)
+	self.NetworkSettings.Networks = map[string]dockerContainerNetwork{
+		"monitoring": {IPAddress: "10.0.0.10"},
+		"frontend":   {IPAddress: "10.0.1.10"},
+		"ingress":    {IPAddress: "10.255.0.10"},
+	}
+
+	state := dockerState{
+		containers: []dockerContainer{containerDef("0123456789abcdef", nil), self},
+	}
+
+	networkNames, err := selfNetworkNames(state, "3f4d2c1b0a9e") // short ID from hostname
+	assert.Ok(t, err)
+	assert.EqualString(t, strings.Join(networkNames, ","), "frontend,monitoring")
+}
+
+func TestSelfNetworkNamesFromTask(t *testing.T) {
+	self := selfTaskDef("ingress", "monitoring", "frontend")
+
+	// our container is also visible, but it doesn't know the order of the networks
+	selfContainer := containerDef(selfContainerIdFull, map[string]string{udocker.SwarmServiceNameLabelKey: "promswarmconnect"})
+	selfContainer.NetworkSettings.Networks = map[string]dockerContainerNetwork{
+		"monitoring": {IPAddress: "10.0.0.10"},
+		"frontend":   {IPAddress: "10.0.1.10"},
+		"ingress":    {IPAddress: "10.255.0.10"},
+	}
+
+	networkNames, err := selfNetworkNames(dockerState{
+		tasks:      []dockerTask{taskDef("othertask", taskStateRunning, taskStateRunning), self},
+		containers: []dockerContainer{selfContainer},
+	}, selfContainerIdFull)
+	assert.Ok(t, err)
+	assert.EqualString(t, strings.Join(networkNames, ","), "monitoring,frontend")
+}
+
+func TestSelfNetworkNamesNoScrapeableNetworks(t *testing.T) {
+	_, err := selfNetworkNames(dockerState{
+		tasks: []dockerTask{selfTaskDef("ingress")},
+	}, selfContainerIdFull)
+
+	assert.EqualString(
+		t,
+		err.Error(),
+		"NETWORK_NAME not set and own container ("+selfContainerIdFull+") is not on any network we can scrape over (attached: ingress)")
+}
+
+func TestSelfNetworkNamesNotFound(t *testing.T) {
+	// custom hostname is not a container ID
+	_, _, err := dockerStateToServices(dockerState{
+		containers: []dockerContainer{containerDef("0123456789abcdef", nil)},
+	}, dockerDiscoveryConfig{selfContainerId: "myhost"})
+
+	assert.EqualString(
+		t,
+		err.Error(),
+		"NETWORK_NAME not set and own container (myhost) not found to detect networks from. are we connected to the Docker we're running on?")
+}
+
+func selfTaskDef(networkNames ...string) dockerTask {
+	self := taskDef("selftask", taskStateRunning, taskStateRunning)
+	self.Status.ContainerStatus.ContainerID = selfContainerIdFull
+	self.NetworksAttachments = nil
+
+	for _, networkName := range networkNames {
+		self.NetworksAttachments = append(self.NetworksAttachments, udocker.TaskNetworkAttachment{
+			Network: udocker.TaskNetworkAttachmentNetwork{
+				Spec: udocker.TaskNetworkAttachmentNetworkSpec{Name: networkName},
+			},
+			Addresses: []string{"10.0.0.10/24"},
+		})
+	}
+
+	return self
+}
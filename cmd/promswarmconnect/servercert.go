@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+)
+
+const serverCertReloadCheckInterval = 10 * time.Second
+
+// TLS certificate for our HTTPS server. either user-supplied (TLS_CERT + TLS_CERT_KEY) or by
+// default a self-signed one generated at startup, so that each deployment has its own key.
+//
+// user-supplied certs follow the getDataFromEnvBase64OrFile() convention. when read from
+// files, they're reloaded when the files change (think certs issued by internal CA that get
+// renewed).
+type serverCertificate struct {
+	certPath string // only set if cert is read from files
+	keyPath  string
+	logl     *logex.Leveled
+
+	mu           sync.Mutex
+	cert         *tls.Certificate
+	lastModified time.Time // newest modification time of cert & key files
+	lastChecked  time.Time
+}
+
+func serverCertificateFromEnv(logger *log.Logger) (*serverCertificate, error) {
+	logl := logex.Levels(logger)
+
+	if os.Getenv("TLS_CERT") == "" && os.Getenv("TLS_CERT_KEY") == "" {
+		certPem, keyPem, err := selfSignedCertificatePem(time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			return nil, err
+		}
+
+		logl.Info.Println("using generated self-signed certificate")
+
+		return &serverCertificate{cert: &cert, logl: logl}, nil
+	}
+
+	certPath, keyPath := filePathFromEnv("TLS_CERT"), filePathFromEnv("TLS_CERT_KEY")
+	if certPath != "" && keyPath != "" {
+		s := &serverCertificate{
+			certPath: certPath,
+			keyPath:  keyPath,
+			logl:     logl,
+		}
+
+		return s, s.reloadIfChanged(time.Now())
+	}
+
+	certPem, err := getDataFromEnvBase64OrFile("TLS_CERT")
+	if err != nil {
+		return nil, err
+	}
+
+	keyPem, err := getDataFromEnvBase64OrFile("TLS_CERT_KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	return &serverCertificate{cert: &cert, logl: logl}, nil
+}
+
+// for tls.Config.GetCertificate
+func (s *serverCertificate) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	shouldCheck := s.certPath != "" && now.Sub(s.lastChecked) >= serverCertReloadCheckInterval
+	s.mu.Unlock()
+
+	if shouldCheck {
+		if err := s.reloadIfChanged(now); err != nil {
+			// files might be mid-update (cert written but key not yet). keep using the
+			// previous cert, we'll try again on next check
+			s.logl.Error.Printf("reloading certificate: %v", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cert, nil
+}
+
+func (s *serverCertificate) reloadIfChanged(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastChecked = now
+
+	lastModified := time.Time{}
+	for _, path := range []string{s.certPath, s.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		if info.ModTime().After(lastModified) {
+			lastModified = info.ModTime()
+		}
+	}
+
+	if s.cert != nil && lastModified.Equal(s.lastModified) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certPath, s.keyPath)
+	if err != nil {
+		return err
+	}
+
+	if s.cert != nil {
+		s.logl.Info.Println("certificate reloaded")
+	}
+
+	s.cert = &cert
+	s.lastModified = lastModified
+
+	return nil
+}
+
+// "@/run/secrets/cert.pem" => "/run/secrets/cert.pem"
+// "<base64>" => ""
+func filePathFromEnv(key string) string {
+	if value := os.Getenv(key); strings.HasPrefix(value, "@") {
+		return value[1:]
+	}
+
+	return ""
+}
+
+// Prometheus doesn't verify our certificate anyway, so we don't need a CA
+func selfSignedCertificatePem(now time.Time) ([]byte, []byte, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: "promswarmconnect"},
+		DNSNames:     []string{"promswarmconnect"},
+		NotBefore:    now.Add(-1 * time.Hour), // tolerate some clock skew
+		NotAfter:     now.AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	if certPem == nil || keyPem == nil {
+		return nil, nil, errors.New("failed encoding PEM")
+	}
+
+	return certPem, keyPem, nil
+}
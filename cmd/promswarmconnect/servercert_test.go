@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestServerCertificateReloadsWhenFilesChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promswarmconnect-servercert-")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "cert.key")
+
+	writeCert := func(modified time.Time) {
+		t.Helper()
+
+		certPem, keyPem, err := selfSignedCertificatePem(time.Now())
+		assert.Ok(t, err)
+
+		assert.Ok(t, ioutil.WriteFile(certPath, certPem, 0600))
+		assert.Ok(t, ioutil.WriteFile(keyPath, keyPem, 0600))
+		assert.Ok(t, os.Chtimes(certPath, modified, modified))
+		assert.Ok(t, os.Chtimes(keyPath, modified, modified))
+	}
+
+	writeCert(time.Now().Add(-time.Hour))
+
+	os.Setenv("TLS_CERT", "@"+certPath)
+	os.Setenv("TLS_CERT_KEY", "@"+keyPath)
+	defer os.Unsetenv("TLS_CERT")
+	defer os.Unsetenv("TLS_CERT_KEY")
+
+	serverCert, err := serverCertificateFromEnv(logex.Discard)
+	assert.Ok(t, err)
+
+	first, err := serverCert.GetCertificate(nil)
+	assert.Ok(t, err)
+
+	writeCert(time.Now())
+
+	// not yet time to check for changes
+	sameAsFirst, err := serverCert.GetCertificate(nil)
+	assert.Ok(t, err)
+	assert.Assert(t, sameAsFirst == first)
+
+	serverCert.lastChecked = time.Now().Add(-serverCertReloadCheckInterval)
+
+	reloaded, err := serverCert.GetCertificate(nil)
+	assert.Ok(t, err)
+	assert.Assert(t, reloaded != first)
+	assert.Assert(t, serialNumber(t, reloaded) != serialNumber(t, first))
+}
+
+func TestServerCertificateSelfSignedByDefault(t *testing.T) {
+	serverCert, err := serverCertificateFromEnv(logex.Discard)
+	assert.Ok(t, err)
+
+	cert, err := serverCert.GetCertificate(nil)
+	assert.Ok(t, err)
+
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Ok(t, err)
+	assert.EqualString(t, parsed.Subject.CommonName, "promswarmconnect")
+}
+
+func serialNumber(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Ok(t, err)
+
+	return parsed.SerialNumber.String()
+}
@@ -21,9 +21,11 @@ func metricsEndpointToTritonResponse(endpoints []MetricsEndpoint) TritonDiscover
 		// we must redirect them into other/correct fields anyway by hacking with
 		// Prometheus relabeling ("VMAlias actually means __address_" etc) configuration.
 		// without relabeling the Triton plugin code in Prometheus requires DNS suffixes etc.
+		// there's no field left for endpoint.Labels, params or the scrape interval/timeout, so
+		// they're only available via HTTP SD.
 		containers = append(containers, TritonDiscoveryResponseContainer{
 			VMImageUUID: endpoint.Job,
-			VMUUID:      endpoint.Instance,
+			VMUUID:      tritonInstance(endpoint),
 			VMAlias:     endpoint.Address,
 			ServerUUID:  endpoint.MetricsPath,
 			VMBrand:     endpoint.Scheme,
@@ -35,6 +37,16 @@ func metricsEndpointToTritonResponse(endpoints []MetricsEndpoint) TritonDiscover
 	}
 }
 
-func serviceInstancesToTritonContainers(services []Service) TritonDiscoveryResponse {
-	return metricsEndpointToTritonResponse(serviceToMetricsEndpoints(services))
+// Triton's fields are fixed, so we can't add a "cluster" label. instead we qualify the
+// instance label, so the same service in different clusters doesn't produce clashing series.
+func tritonInstance(endpoint MetricsEndpoint) string {
+	if endpoint.Cluster == "" {
+		return endpoint.Instance
+	}
+
+	return endpoint.Cluster + "/" + endpoint.Instance
+}
+
+func serviceInstancesToTritonContainers(services []Service, defaultJobStrategy jobNameStrategy) TritonDiscoveryResponse {
+	return metricsEndpointToTritonResponse(serviceToMetricsEndpoints(services, defaultJobStrategy))
 }
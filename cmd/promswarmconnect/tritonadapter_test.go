@@ -18,7 +18,7 @@ func TestServiceInstancesToTritonContainers(t *testing.T) {
 				DockerTaskId: "task1",
 				NodeID:       "node1",
 				NodeHostname: "node1.example.com",
-				IPv4:         "10.0.0.2",
+				Networks:     []ServiceInstanceNetwork{{Name: "monitoring", IPs: []string{"10.0.0.2"}}},
 			},
 		},
 	}
@@ -34,21 +34,21 @@ func TestServiceInstancesToTritonContainers(t *testing.T) {
 				DockerTaskId: "task1",
 				NodeID:       "node1",
 				NodeHostname: "node1.example.com",
-				IPv4:         "10.0.0.2",
+				Networks:     []ServiceInstanceNetwork{{Name: "monitoring", IPs: []string{"10.0.0.2"}}},
 			},
 			{
 				DockerTaskId: "task2",
 				NodeID:       "node1",
 				NodeHostname: "node1.example.com",
-				IPv4:         "10.0.0.3",
+				Networks:     []ServiceInstanceNetwork{{Name: "monitoring", IPs: []string{"10.0.0.3"}}},
 			},
 		},
 	}
 
-	noProperEnvVarResult := serviceInstancesToTritonContainers([]Service{dummySvc1WithoutProperEnvVar})
+	noProperEnvVarResult := serviceInstancesToTritonContainers([]Service{dummySvc1WithoutProperEnvVar}, "")
 	assert.Assert(t, len(noProperEnvVarResult.Containers) == 0)
 
-	assert.EqualJson(t, serviceInstancesToTritonContainers([]Service{dummySvc2}), `{
+	assert.EqualJson(t, serviceInstancesToTritonContainers([]Service{dummySvc2}, ""), `{
   "containers": [
     {
       "server_uuid": "/metrics",
@@ -81,11 +81,11 @@ func TestHttps(t *testing.T) {
 					DockerTaskId: "task1",
 					NodeID:       "node1",
 					NodeHostname: "node1.example.com",
-					IPv4:         "10.0.0.2",
+					Networks:     []ServiceInstanceNetwork{{Name: "monitoring", IPs: []string{"10.0.0.2"}}},
 				},
 			},
 		},
-	})
+	}, "")
 
 	assert.EqualJson(t, result, `{
   "containers": [
@@ -2,4 +2,8 @@ module github.com/function61/promswarmconnect
 
 go 1.13
 
-require github.com/function61/gokit v0.0.0-20210702104928-d82199d64092
+require (
+	github.com/function61/gokit v0.0.0-20210702104928-d82199d64092
+	github.com/prometheus/client_golang v1.1.0
+	github.com/prometheus/common v0.9.1
+)